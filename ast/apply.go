@@ -0,0 +1,306 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/*
+An ApplyFunc is called by Apply for each node, with a Cursor positioned at
+the node. Its result controls the traversal, as described for Apply.
+*/
+type ApplyFunc func(*Cursor) bool
+
+/*
+Apply traverses an AST in the same order as Walk, calling pre for each node
+before its children and post after them, and returns the possibly modified
+root. Either function may be nil.
+
+If pre returns false, the node's children and post are skipped. If post
+returns false, the traversal stops there. Through the Cursor, either function
+may replace the current node, and pre's replacement is the one whose children
+are traversed. Nodes inserted with InsertBefore and InsertAfter are not
+traversed.
+*/
+func Apply(root Node, pre, post ApplyFunc) (result Node) {
+	defer func() {
+		if r := recover(); r != nil && r != abort {
+			panic(r)
+		}
+		result = root
+	}()
+	a := &application{pre: pre, post: post}
+	a.apply(Cursor{root: &root, node: root})
+	return
+}
+
+var abort = new(int) // a unique value, to unwind the stack when post returns false
+
+/* A Cursor describes a node found during Apply */
+type Cursor struct {
+	parent Node
+	name   string
+	iter   *iterator // set if the node is in a list, or in a hash pair
+	pair   bool      // the node is the Key or Value of parent.Pairs[iter.index]
+	root   *Node     // set for the root, which has no parent to hold it
+	node   Node
+}
+
+/* An iterator is the position in a list that Apply is going through */
+type iterator struct {
+	index, step int
+}
+
+/* Node is the current node */
+func (c *Cursor) Node() Node { return c.node }
+
+/* Parent is the node containing the current node, or nil for the root */
+func (c *Cursor) Parent() Node { return c.parent }
+
+/*
+Name is the name of the parent's field holding the current node, such as
+"Right" or "Statements". Keys and values of a HashLiteral are named "Key" and
+"Value". The root's name is "".
+*/
+func (c *Cursor) Name() string { return c.name }
+
+/*
+Index is the current node's position in its parent's list, or its pair's
+position in a HashLiteral's Pairs. Otherwise it's -1.
+*/
+func (c *Cursor) Index() int {
+	if c.iter != nil {
+		return c.iter.index
+	}
+	return -1
+}
+
+/* Replace puts n where the current node was. n may be nil. */
+func (c *Cursor) Replace(n Node) {
+	slot := c.field()
+	if c.iter != nil && !c.pair {
+		slot = slot.Index(c.iter.index)
+	}
+	slot.Set(c.value(n, slot.Type(), "Replace"))
+	c.node = n
+}
+
+/* Delete removes the current node from its parent's list */
+func (c *Cursor) Delete() {
+	i, list := c.list("Delete")
+	l := list.Len()
+	reflect.Copy(list.Slice(i, l), list.Slice(i+1, l))
+	list.Index(l - 1).Set(reflect.Zero(list.Type().Elem()))
+	list.SetLen(l - 1)
+	c.iter.step--
+}
+
+/* InsertBefore puts n into the current node's list, just before it */
+func (c *Cursor) InsertBefore(n Node) {
+	i, list := c.list("InsertBefore")
+	value := c.value(n, list.Type().Elem(), "InsertBefore")
+	list.Set(reflect.Append(list, reflect.Zero(list.Type().Elem())))
+	l := list.Len()
+	reflect.Copy(list.Slice(i+1, l), list.Slice(i, l))
+	list.Index(i).Set(value)
+	c.iter.index++
+}
+
+/* InsertAfter puts n into the current node's list, just after it */
+func (c *Cursor) InsertAfter(n Node) {
+	i, list := c.list("InsertAfter")
+	value := c.value(n, list.Type().Elem(), "InsertAfter")
+	list.Set(reflect.Append(list, reflect.Zero(list.Type().Elem())))
+	l := list.Len()
+	reflect.Copy(list.Slice(i+2, l), list.Slice(i+1, l))
+	list.Index(i + 1).Set(value)
+	c.iter.step++
+}
+
+/* field is the parent's field holding the current node, or its list */
+func (c *Cursor) field() reflect.Value {
+	if c.root != nil {
+		return reflect.ValueOf(c.root).Elem()
+	}
+	v := reflect.Indirect(reflect.ValueOf(c.parent))
+	if c.pair {
+		return v.FieldByName("Pairs").Index(c.iter.index).FieldByName(c.name)
+	}
+	return v.FieldByName(c.name)
+}
+
+func (c *Cursor) list(method string) (int, reflect.Value) {
+	if c.iter == nil || c.pair {
+		panic(fmt.Sprintf("ast.Cursor.%s: %s is not a list", method, c.where()))
+	}
+	return c.iter.index, c.field()
+}
+
+/* where describes the current node's place, for panics */
+func (c *Cursor) where() string {
+	if c.root != nil {
+		return "the root"
+	}
+	return fmt.Sprintf("%T.%s", c.parent, c.name)
+}
+
+/* value checks that n can go in a field or list of type typ */
+func (c *Cursor) value(n Node, typ reflect.Type, method string) reflect.Value {
+	if n == nil {
+		if typ.Kind() != reflect.Interface && typ.Kind() != reflect.Ptr {
+			panic(fmt.Sprintf("ast.Cursor.%s: nil in %s", method, c.where()))
+		}
+		return reflect.Zero(typ)
+	}
+	if !reflect.TypeOf(n).AssignableTo(typ) {
+		panic(fmt.Sprintf("ast.Cursor.%s: %T in %s, which holds %s",
+			method, n, c.where(), typ))
+	}
+	return reflect.ValueOf(n)
+}
+
+type application struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+	iter      iterator
+}
+
+/* apply visits the node at cursor, unless a failed parse left it nil */
+func (a *application) apply(cursor Cursor) {
+	if isNil(cursor.node) {
+		return
+	}
+
+	saved := a.cursor
+	a.cursor = cursor
+	if a.pre != nil && !a.pre(&a.cursor) {
+		a.cursor = saved
+		return
+	}
+
+	switch n := a.cursor.node.(type) {
+	case nil:
+		// replaced with nothing by pre
+
+	/* Statements */
+	case *LetStatement:
+		a.applyField(n, "Name", n.Name)
+		a.applyField(n, "Value", n.Value)
+
+	case *ReturnStatement:
+		a.applyField(n, "Value", n.Value)
+
+	case *ExpressionStatement:
+		a.applyField(n, "Expression", n.Expression)
+
+	case *WhileStatement:
+		a.applyField(n, "Condition", n.Condition)
+		a.applyField(n, "Body", n.Body)
+
+	case *ForStatement:
+		a.applyField(n, "Init", n.Init)
+		a.applyField(n, "Condition", n.Condition)
+		a.applyField(n, "Post", n.Post)
+		a.applyField(n, "Body", n.Body)
+
+	case *BreakStatement, *ContinueStatement:
+		// nothing to do
+
+	case *BlockStatement:
+		a.applyList(n, "Statements")
+
+	/* Expressions */
+	case *Identifier, *IntegerLiteral, *FloatLiteral, *StringLiteral, *Boolean:
+		// nothing to do
+
+	case *PrefixExpression:
+		a.applyField(n, "Right", n.Right)
+
+	case *InfixExpression:
+		a.applyField(n, "Left", n.Left)
+		a.applyField(n, "Right", n.Right)
+
+	case *AssignExpression:
+		a.applyField(n, "Target", n.Target)
+		a.applyField(n, "Value", n.Value)
+
+	case *ParenExpression:
+		a.applyField(n, "Expression", n.Expression)
+
+	case *IfExpression:
+		a.applyField(n, "Condition", n.Condition)
+		a.applyField(n, "IfBlock", n.IfBlock)
+		a.applyField(n, "ElseBlock", n.ElseBlock)
+
+	case *FunctionLiteral:
+		a.applyList(n, "Parameters")
+		a.applyField(n, "Body", n.Body)
+
+	case *CallExpression:
+		a.applyField(n, "Function", n.Function)
+		a.applyList(n, "Arguments")
+
+	case *ArrayLiteral:
+		a.applyList(n, "Elements")
+
+	case *IndexExpression:
+		a.applyField(n, "Left", n.Left)
+		a.applyField(n, "Index", n.Index)
+
+	case *HashLiteral:
+		a.applyPairs(n)
+
+	/* Program */
+	case *Program:
+		a.applyList(n, "Statements")
+
+	default:
+		panic(fmt.Sprintf("ast.Apply: unexpected node type %T", n))
+	}
+
+	if a.post != nil && !a.post(&a.cursor) {
+		panic(abort)
+	}
+	a.cursor = saved
+}
+
+func (a *application) applyField(parent Node, name string, n Node) {
+	a.apply(Cursor{parent: parent, name: name, node: n})
+}
+
+func (a *application) applyList(parent Node, name string) {
+	saved := a.iter
+	a.iter.index = 0
+	for {
+		/* Reload the list each time, as the cursor may have changed it */
+		list := reflect.Indirect(reflect.ValueOf(parent)).FieldByName(name)
+		if a.iter.index >= list.Len() {
+			break
+		}
+		n, _ := list.Index(a.iter.index).Interface().(Node)
+		a.iter.step = 1
+		a.apply(Cursor{parent: parent, name: name, iter: &a.iter, node: n})
+		a.iter.index += a.iter.step
+	}
+	a.iter = saved
+}
+
+func (a *application) applyPairs(hash *HashLiteral) {
+	saved := a.iter
+	for a.iter.index = 0; a.iter.index < len(hash.Pairs); a.iter.index++ {
+		key := hash.Pairs[a.iter.index].Key
+		a.apply(Cursor{parent: hash, name: "Key", iter: &a.iter, pair: true, node: key})
+		value := hash.Pairs[a.iter.index].Value
+		a.apply(Cursor{parent: hash, name: "Value", iter: &a.iter, pair: true, node: value})
+	}
+	a.iter = saved
+}
+
+/* isNil catches typed nils too, such as a missing *BlockStatement */
+func isNil(n Node) bool {
+	if n == nil {
+		return true
+	}
+	v := reflect.ValueOf(n)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
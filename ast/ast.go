@@ -2,13 +2,18 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/cowlet/moncow/token"
+	"strings"
+	"unicode"
 )
 
 /* Interfaces */
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() int // byte offset of the node's first character
+	End() int // byte offset just past the node's last character
 }
 
 type Statement interface {
@@ -21,6 +26,12 @@ type Expression interface {
 	expressionNode()
 }
 
+/* An ElseNode follows else: a *BlockStatement, or an *IfExpression for "else if" */
+type ElseNode interface {
+	Node
+	elseNode()
+}
+
 /* Statements */
 type LetStatement struct {
 	Token token.Token
@@ -30,6 +41,8 @@ type LetStatement struct {
 
 func (ls *LetStatement) statementNode()       {}
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *LetStatement) Pos() int             { return ls.Token.Pos.Offset }
+func (ls *LetStatement) End() int             { return endOf(ls.Token, ls.Name, ls.Value) }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
@@ -50,6 +63,8 @@ type ReturnStatement struct {
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() int             { return rs.Token.Pos.Offset }
+func (rs *ReturnStatement) End() int             { return endOf(rs.Token, rs.Value) }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -68,6 +83,8 @@ type ExpressionStatement struct {
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() int             { return posOf(es.Token, es.Expression) }
+func (es *ExpressionStatement) End() int             { return endOf(es.Token, es.Expression) }
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -75,6 +92,79 @@ func (es *ExpressionStatement) String() string {
 	return ""
 }
 
+type WhileStatement struct {
+	Token     token.Token // the 'while' token
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (ws *WhileStatement) statementNode()       {}
+func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+func (ws *WhileStatement) Pos() int             { return ws.Token.Pos.Offset }
+func (ws *WhileStatement) End() int             { return endOf(ws.Token, ws.Condition, ws.Body) }
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("while ")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(ws.Body.String())
+	return out.String()
+}
+
+/* Init, Condition and Post are each optional, and nil if left out */
+type ForStatement struct {
+	Token     token.Token // the 'for' token
+	Init      Statement
+	Condition Expression
+	Post      Expression
+	Body      *BlockStatement
+}
+
+func (fs *ForStatement) statementNode()       {}
+func (fs *ForStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForStatement) Pos() int             { return fs.Token.Pos.Offset }
+func (fs *ForStatement) End() int             { return endOf(fs.Token, fs.Init, fs.Condition, fs.Post, fs.Body) }
+func (fs *ForStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("for (")
+	if fs.Init != nil {
+		out.WriteString(strings.TrimSuffix(fs.Init.String(), ";"))
+	}
+	out.WriteString("; ")
+	if fs.Condition != nil {
+		out.WriteString(fs.Condition.String())
+	}
+	out.WriteString("; ")
+	if fs.Post != nil {
+		out.WriteString(fs.Post.String())
+	}
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+	return out.String()
+}
+
+type BreakStatement struct {
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() int             { return bs.Token.Pos.Offset }
+func (bs *BreakStatement) End() int             { return bs.Token.End.Offset }
+func (bs *BreakStatement) String() string       { return bs.TokenLiteral() + ";" }
+
+type ContinueStatement struct {
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() int             { return cs.Token.Pos.Offset }
+func (cs *ContinueStatement) End() int             { return cs.Token.End.Offset }
+func (cs *ContinueStatement) String() string       { return cs.TokenLiteral() + ";" }
+
 /* Expressions */
 type Identifier struct {
 	Token token.Token
@@ -83,6 +173,8 @@ type Identifier struct {
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() int             { return i.Token.Pos.Offset }
+func (i *Identifier) End() int             { return i.Token.End.Offset }
 func (i *Identifier) String() string       { return i.Value }
 
 type IntegerLiteral struct {
@@ -92,6 +184,8 @@ type IntegerLiteral struct {
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() int             { return il.Token.Pos.Offset }
+func (il *IntegerLiteral) End() int             { return il.Token.End.Offset }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
 type FloatLiteral struct {
@@ -101,8 +195,50 @@ type FloatLiteral struct {
 
 func (fl *FloatLiteral) expressionNode()      {}
 func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() int             { return fl.Token.Pos.Offset }
+func (fl *FloatLiteral) End() int             { return fl.Token.End.Offset }
 func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
 
+type StringLiteral struct {
+	Token token.Token
+	Value string // decoded, without quotes
+}
+
+func (sl *StringLiteral) expressionNode()      {}
+func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() int             { return sl.Token.Pos.Offset }
+func (sl *StringLiteral) End() int             { return sl.Token.End.Offset }
+func (sl *StringLiteral) String() string       { return quote(sl.Value) }
+
+/* quote is the inverse of the lexer's string decoding */
+func quote(s string) string {
+	var out bytes.Buffer
+
+	out.WriteString("\"")
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString("\\\"")
+		case '\\':
+			out.WriteString("\\\\")
+		case '\n':
+			out.WriteString("\\n")
+		case '\t':
+			out.WriteString("\\t")
+		case '\r':
+			out.WriteString("\\r")
+		default:
+			if unicode.IsPrint(r) {
+				out.WriteRune(r)
+			} else {
+				out.WriteString(fmt.Sprintf("\\u{%X}", r))
+			}
+		}
+	}
+	out.WriteString("\"")
+	return out.String()
+}
+
 type Boolean struct {
 	Token token.Token
 	Value bool
@@ -110,6 +246,8 @@ type Boolean struct {
 
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
+func (b *Boolean) Pos() int             { return b.Token.Pos.Offset }
+func (b *Boolean) End() int             { return b.Token.End.Offset }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
 type PrefixExpression struct {
@@ -120,6 +258,8 @@ type PrefixExpression struct {
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() int             { return pe.Token.Pos.Offset }
+func (pe *PrefixExpression) End() int             { return endOf(pe.Token, pe.Right) }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -140,6 +280,8 @@ type InfixExpression struct {
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() int             { return posOf(ie.Token, ie.Left) }
+func (ie *InfixExpression) End() int             { return endOf(ie.Token, ie.Right) }
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -154,40 +296,243 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 
+/* Target is an *Identifier or an *IndexExpression, perhaps in parentheses */
+type AssignExpression struct {
+	Token    token.Token // the operator token, = or +=, -=, *=, /=
+	Target   Expression
+	Operator string
+	Value    Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) Pos() int             { return posOf(ae.Token, ae.Target) }
+func (ae *AssignExpression) End() int             { return endOf(ae.Token, ae.Value) }
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ae.Target.String())
+	out.WriteString(" " + ae.Operator + " ")
+	out.WriteString(ae.Value.String())
+	out.WriteString(")")
+	return out.String()
+}
+
+/* A ParenExpression is an expression written in parentheses */
+type ParenExpression struct {
+	Token      token.Token // the '(' token
+	Expression Expression
+	Rparen     token.Token
+}
+
+func (pe *ParenExpression) expressionNode()      {}
+func (pe *ParenExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *ParenExpression) Pos() int             { return pe.Token.Pos.Offset }
+func (pe *ParenExpression) End() int             { return closeOf(pe.Token, pe.Rparen) }
+
+/* The tree's shape already shows the grouping, so the parentheses aren't printed again */
+func (pe *ParenExpression) String() string {
+	if pe.Expression == nil {
+		return ""
+	}
+	return pe.Expression.String()
+}
+
+/* Unparen gives the expression inside any parentheses around exp */
+func Unparen(exp Expression) Expression {
+	for {
+		pe, ok := exp.(*ParenExpression)
+		if !ok || pe.Expression == nil {
+			return exp
+		}
+		exp = pe.Expression
+	}
+}
+
 type IfExpression struct {
 	Token     token.Token
 	Condition Expression
 	IfBlock   *BlockStatement
-	ElseBlock *BlockStatement
+	ElseBlock ElseNode
 }
 
 func (ie *IfExpression) expressionNode()      {}
+func (ie *IfExpression) elseNode()            {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() int             { return ie.Token.Pos.Offset }
+func (ie *IfExpression) End() int {
+	return endOf(ie.Token, ie.Condition, ie.IfBlock, ie.ElseBlock)
+}
+
+/* An else-if chain prints flat, rather than as nested if expressions */
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
-	out.WriteString("(if ")
-	if ie.Condition != nil {
-		out.WriteString(ie.Condition.String())
-		out.WriteString(" then ")
+	out.WriteString("(")
+	for link := ie; link != nil; {
+		out.WriteString("if ")
+		if link.Condition != nil {
+			out.WriteString(link.Condition.String())
+			out.WriteString(" then ")
+		}
+		if link.IfBlock != nil {
+			out.WriteString(link.IfBlock.String())
+		}
+
+		next, chained := link.ElseBlock.(*IfExpression)
+		if link.ElseBlock != nil {
+			out.WriteString(" else ")
+			if !chained {
+				out.WriteString(link.ElseBlock.String())
+			}
+		}
+		link = next
+	}
+	out.WriteString(")")
+	return out.String()
+}
+
+type FunctionLiteral struct {
+	Token      token.Token // the 'fn' token
+	Parameters []*Identifier
+	Body       *BlockStatement
+}
+
+func (fl *FunctionLiteral) expressionNode()      {}
+func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() int             { return fl.Token.Pos.Offset }
+func (fl *FunctionLiteral) End() int             { return endOf(fl.Token, fl.Body) }
+func (fl *FunctionLiteral) String() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range fl.Parameters {
+		params = append(params, p.String())
 	}
-	if ie.IfBlock != nil {
-		out.WriteString(ie.IfBlock.String())
+	out.WriteString(fl.TokenLiteral())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") ")
+	if fl.Body != nil {
+		out.WriteString(fl.Body.String())
 	}
-	if ie.ElseBlock != nil {
-		out.WriteString(" else ")
-		out.WriteString(ie.ElseBlock.String())
+	return out.String()
+}
+
+type CallExpression struct {
+	Token     token.Token // the '(' token
+	Function  Expression  // Identifier or FunctionLiteral
+	Arguments []Expression
+	Rparen    token.Token
+}
+
+func (ce *CallExpression) expressionNode()      {}
+func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() int             { return posOf(ce.Token, ce.Function) }
+func (ce *CallExpression) End() int             { return closeOf(ce.Token, ce.Rparen) }
+func (ce *CallExpression) String() string {
+	var out bytes.Buffer
+
+	args := []string{}
+	for _, a := range ce.Arguments {
+		args = append(args, a.String())
 	}
+	if ce.Function != nil {
+		out.WriteString(ce.Function.String())
+	}
+	out.WriteString("(")
+	out.WriteString(strings.Join(args, ", "))
 	out.WriteString(")")
 	return out.String()
 }
 
+type ArrayLiteral struct {
+	Token    token.Token // the '[' token
+	Elements []Expression
+	Rbracket token.Token
+}
+
+func (al *ArrayLiteral) expressionNode()      {}
+func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() int             { return al.Token.Pos.Offset }
+func (al *ArrayLiteral) End() int             { return closeOf(al.Token, al.Rbracket) }
+func (al *ArrayLiteral) String() string {
+	var out bytes.Buffer
+
+	elements := []string{}
+	for _, el := range al.Elements {
+		elements = append(elements, el.String())
+	}
+	out.WriteString("[")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("]")
+	return out.String()
+}
+
+type IndexExpression struct {
+	Token    token.Token // the '[' token
+	Left     Expression
+	Index    Expression
+	Rbracket token.Token
+}
+
+func (ie *IndexExpression) expressionNode()      {}
+func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() int             { return posOf(ie.Token, ie.Left) }
+func (ie *IndexExpression) End() int             { return closeOf(ie.Token, ie.Rbracket) }
+func (ie *IndexExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	if ie.Left != nil {
+		out.WriteString(ie.Left.String())
+	}
+	out.WriteString("[")
+	if ie.Index != nil {
+		out.WriteString(ie.Index.String())
+	}
+	out.WriteString("])")
+	return out.String()
+}
+
+type HashLiteral struct {
+	Token  token.Token // the '{' token
+	Pairs  []HashPair  // in source order
+	Rbrace token.Token
+}
+
+type HashPair struct {
+	Key   Expression
+	Value Expression
+}
+
+func (hl *HashLiteral) expressionNode()      {}
+func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() int             { return hl.Token.Pos.Offset }
+func (hl *HashLiteral) End() int             { return closeOf(hl.Token, hl.Rbrace) }
+func (hl *HashLiteral) String() string {
+	var out bytes.Buffer
+
+	pairs := []string{}
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
+	}
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+	return out.String()
+}
+
 type BlockStatement struct {
 	Token      token.Token
 	Statements []Statement
+	Rbrace     token.Token
 }
 
 func (bs *BlockStatement) statementNode()       {}
+func (bs *BlockStatement) elseNode()            {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() int             { return bs.Token.Pos.Offset }
+func (bs *BlockStatement) End() int             { return closeOf(bs.Token, bs.Rbrace) }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("{ ")
@@ -211,6 +556,20 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() int {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return 0
+}
+
+func (p *Program) End() int {
+	if len(p.Statements) > 0 {
+		return p.Statements[len(p.Statements)-1].End()
+	}
+	return 0
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -220,3 +579,29 @@ func (p *Program) String() string {
 
 	return out.String()
 }
+
+/* posOf is where the first node starts, or tok if a failed parse left it nil */
+func posOf(tok token.Token, first Node) int {
+	if isNil(first) {
+		return tok.Pos.Offset
+	}
+	return first.Pos()
+}
+
+/* endOf is where the last non-nil node ends, or else where tok ends */
+func endOf(tok token.Token, nodes ...Node) int {
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if !isNil(nodes[i]) {
+			return nodes[i].End()
+		}
+	}
+	return tok.End.Offset
+}
+
+/* closeOf is where a closing token ends, or else where the opening one does */
+func closeOf(open, close token.Token) int {
+	if close.Type == "" {
+		return open.End.Offset
+	}
+	return close.End.Offset
+}
@@ -1,7 +1,16 @@
 package ast
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/cowlet/moncow/token"
+	goast "go/ast"
+	goparser "go/parser"
+	gotoken "go/token"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -26,3 +35,601 @@ func TestString(t *testing.T) {
 		t.Errorf("program.String() wrong, got '%q'", program.String())
 	}
 }
+
+/* One of every node type. Add new node types here, and to Walk. */
+func allNodes() []Node {
+	return []Node{
+		&LetStatement{}, &ReturnStatement{}, &ExpressionStatement{},
+		&WhileStatement{}, &ForStatement{}, &BreakStatement{},
+		&ContinueStatement{}, &BlockStatement{},
+		&Identifier{}, &IntegerLiteral{}, &FloatLiteral{}, &StringLiteral{},
+		&Boolean{}, &PrefixExpression{}, &InfixExpression{},
+		&AssignExpression{}, &ParenExpression{}, &IfExpression{}, &FunctionLiteral{},
+		&CallExpression{}, &ArrayLiteral{}, &IndexExpression{}, &HashLiteral{},
+		&Program{},
+	}
+}
+
+/* nodeTypes finds every type in ast.go with a TokenLiteral method */
+func nodeTypes(t *testing.T) []string {
+	file, err := goparser.ParseFile(gotoken.NewFileSet(), "ast.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*goast.FuncDecl)
+		if !ok || fn.Recv == nil || fn.Name.Name != "TokenLiteral" {
+			continue
+		}
+		recv := fn.Recv.List[0].Type.(*goast.StarExpr).X.(*goast.Ident)
+		names = append(names, recv.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWalkCoversEveryNodeType(t *testing.T) {
+	names := []string{}
+	for _, node := range allNodes() {
+		names = append(names, reflect.TypeOf(node).Elem().Name())
+	}
+	sort.Strings(names)
+	expected := nodeTypes(t)
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("allNodes() is out of date: expected %v, got %v", expected, names)
+	}
+
+	for _, node := range allNodes() {
+		children := fillChildren(t, reflect.ValueOf(node).Elem())
+		visited := directChildren(node)
+		if !reflect.DeepEqual(visited, children) {
+			t.Errorf("Walk(%T) visited %d of its %d children, or out of order",
+				node, len(visited), len(children))
+		}
+		applied := appliedChildren(node)
+		if !reflect.DeepEqual(applied, children) {
+			t.Errorf("Apply(%T) visited %d of its %d children, or out of order",
+				node, len(applied), len(children))
+		}
+		data, err := MarshalJSON(node)
+		if err != nil {
+			t.Fatalf("MarshalJSON(%T) failed: %s", node, err)
+		}
+		decoded, err := UnmarshalJSON(data)
+		if err != nil || !reflect.DeepEqual(decoded, node) {
+			t.Errorf("JSON for %T didn't decode to the same node: %s", node, data)
+		}
+		clone := Clone(node)
+		if !reflect.DeepEqual(clone, node) || !Equal(clone, node) || Hash(clone) != Hash(node) {
+			t.Errorf("Clone(%T) isn't the same as the original", node)
+		}
+		for i, child := range directChildren(clone) {
+			if child == children[i] {
+				t.Errorf("Clone(%T) shares its children with the original", node)
+			}
+		}
+	}
+}
+
+/*
+fillChildren sets every child field of a node, or of a HashPair, to a new
+node, and returns the children in the order they were declared
+*/
+func fillChildren(t *testing.T, v reflect.Value) []Node {
+	var (
+		nodeType       = reflect.TypeOf((*Node)(nil)).Elem()
+		expressionType = reflect.TypeOf((*Expression)(nil)).Elem()
+		statementType  = reflect.TypeOf((*Statement)(nil)).Elem()
+		elseType       = reflect.TypeOf((*ElseNode)(nil)).Elem()
+	)
+	newChild := func(typ reflect.Type) reflect.Value {
+		switch {
+		case typ == expressionType:
+			return reflect.ValueOf(&Identifier{Value: "x"})
+		case typ == statementType:
+			return reflect.ValueOf(&BreakStatement{})
+		case typ == elseType:
+			return reflect.ValueOf(&BlockStatement{})
+		case typ.Kind() == reflect.Ptr && typ.Implements(nodeType):
+			return reflect.New(typ.Elem())
+		}
+		return reflect.Value{}
+	}
+
+	children := []Node{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := v.Type().Name() + "." + v.Type().Field(i).Name
+		typ := field.Type()
+		switch typ.Kind() {
+		case reflect.String, reflect.Int64, reflect.Float64, reflect.Bool:
+			continue
+		case reflect.Struct:
+			if typ == reflect.TypeOf(token.Token{}) {
+				continue
+			}
+		case reflect.Slice:
+			el := reflect.New(typ.Elem()).Elem()
+			if child := newChild(typ.Elem()); child.IsValid() {
+				el.Set(child)
+				children = append(children, child.Interface().(Node))
+			} else if typ.Elem().Kind() == reflect.Struct {
+				children = append(children, fillChildren(t, el)...)
+			} else {
+				t.Fatalf("Don't know how to fill %s", name)
+			}
+			field.Set(reflect.Append(field, el))
+			continue
+		default:
+			if child := newChild(typ); child.IsValid() {
+				field.Set(child)
+				children = append(children, child.Interface().(Node))
+				continue
+			}
+		}
+		t.Fatalf("Don't know how to fill %s", name)
+	}
+	return children
+}
+
+func directChildren(node Node) []Node {
+	children := []Node{}
+	depth := 0
+	Inspect(node, func(n Node) bool {
+		if n == nil {
+			depth--
+			return false
+		}
+		if depth == 1 {
+			children = append(children, n)
+		}
+		depth++
+		return true
+	})
+	return children
+}
+
+/* appliedChildren also replaces each child with itself, to check it can be */
+func appliedChildren(node Node) []Node {
+	children := []Node{}
+	depth := 0
+	Apply(node, func(c *Cursor) bool {
+		if depth == 1 {
+			children = append(children, c.Node())
+			c.Replace(c.Node())
+		}
+		depth++
+		return true
+	}, func(c *Cursor) bool {
+		depth--
+		return true
+	})
+	return children
+}
+
+func TestInspect(t *testing.T) {
+	ident := func(name string) *Identifier {
+		return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+	}
+	/* let f = fn(a) { a + b }; f() */
+	body := &BlockStatement{Statements: []Statement{
+		&ExpressionStatement{Expression: &InfixExpression{
+			Left: ident("a"), Operator: "+", Right: ident("b"),
+		}},
+	}}
+	program := &Program{Statements: []Statement{
+		&LetStatement{Name: ident("f"), Value: &FunctionLiteral{
+			Parameters: []*Identifier{ident("a")}, Body: body,
+		}},
+		&ExpressionStatement{Expression: &CallExpression{Function: ident("f")}},
+	}}
+
+	tests := []struct {
+		skipFunctions bool
+		expected      string
+	}{
+		{false, "Program LetStatement f FunctionLiteral a BlockStatement " +
+			"ExpressionStatement InfixExpression a b ExpressionStatement CallExpression f"},
+		{true, "Program LetStatement f FunctionLiteral " +
+			"ExpressionStatement CallExpression f"},
+	}
+
+	for _, tt := range tests {
+		visited := []string{}
+		opened := 0
+		Inspect(program, func(n Node) bool {
+			if n == nil {
+				opened--
+				return false
+			}
+			opened++
+			if ident, ok := n.(*Identifier); ok {
+				visited = append(visited, ident.Value)
+			} else {
+				visited = append(visited, reflect.TypeOf(n).Elem().Name())
+			}
+			if _, ok := n.(*FunctionLiteral); ok && tt.skipFunctions {
+				opened--
+				return false
+			}
+			return true
+		})
+		if got := strings.Join(visited, " "); got != tt.expected {
+			t.Errorf("Expected visits %q, got %q", tt.expected, got)
+		}
+		if opened != 0 {
+			t.Errorf("Expected f(nil) after each node's children, %d unmatched", opened)
+		}
+	}
+}
+
+func TestWalkSkipsMissingChildren(t *testing.T) {
+	/* As left by parse errors */
+	program := &Program{Statements: []Statement{
+		&LetStatement{Name: &Identifier{Value: "x"}},
+		&ExpressionStatement{Expression: &IfExpression{}},
+		&WhileStatement{},
+		&ForStatement{},
+	}}
+	count := 0
+	Inspect(program, func(n Node) bool {
+		if n != nil {
+			count++
+		}
+		return true
+	})
+	if count != 7 {
+		t.Errorf("Expected 7 nodes visited, got %d", count)
+	}
+}
+
+func TestApply(t *testing.T) {
+	integer := func(value int64) *IntegerLiteral {
+		literal := strconv.FormatInt(value, 10)
+		return &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: literal}, Value: value}
+	}
+	ident := func(name string) *Identifier {
+		return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+	}
+	statement := func(exp Expression) Statement {
+		return &ExpressionStatement{Expression: exp}
+	}
+	infix := func(left Expression, op string, right Expression) *InfixExpression {
+		return &InfixExpression{Left: left, Operator: op, Right: right}
+	}
+
+	/* Folding constants bottom up replaces the Right operand first */
+	program := &Program{Statements: []Statement{
+		statement(infix(ident("x"), "+", infix(integer(2), "*", integer(3)))),
+		statement(infix(integer(1), "-", infix(integer(2), "*", integer(3)))),
+	}}
+	result := Apply(program, nil, func(c *Cursor) bool {
+		if ie, ok := c.Node().(*InfixExpression); ok {
+			left, lok := ie.Left.(*IntegerLiteral)
+			right, rok := ie.Right.(*IntegerLiteral)
+			if lok && rok && ie.Operator == "*" {
+				c.Replace(integer(left.Value * right.Value))
+			} else if lok && rok && ie.Operator == "-" {
+				c.Replace(integer(left.Value - right.Value))
+			}
+		}
+		return true
+	})
+	if result != program || program.String() != "(x+6)-5" {
+		t.Errorf("Expected the program folded to %q, got %q", "(x+6)-5", result.String())
+	}
+
+	/* Statements inside a block can be replaced, deleted and inserted around */
+	block := &BlockStatement{Statements: []Statement{
+		statement(ident("a")), statement(ident("drop")), statement(ident("b")),
+		statement(ident("c")),
+	}}
+	visited := []string{}
+	Apply(block, func(c *Cursor) bool {
+		if _, ok := c.Node().(*ExpressionStatement); !ok {
+			return c.Node() == block
+		}
+		name := c.Node().String()
+		visited = append(visited, name)
+		switch name {
+		case "a":
+			c.InsertBefore(statement(ident("first")))
+		case "drop":
+			c.Delete()
+		case "b":
+			c.Replace(statement(ident("B")))
+			c.InsertAfter(statement(ident("after")))
+		}
+		return false
+	}, nil)
+	if got := strings.Join(visited, " "); got != "a drop b c" {
+		t.Errorf("Expected each original statement visited once, got %q", got)
+	}
+	if block.String() != "{ first; a; B; after; c; }" {
+		t.Errorf("Expected the block rewritten, got %q", block.String())
+	}
+
+	/* Hash keys and values, and the root itself, can be replaced */
+	hash := &HashLiteral{Pairs: []HashPair{{Key: ident("k"), Value: ident("v")}}}
+	result = Apply(hash, func(c *Cursor) bool {
+		if c.Name() == "Key" && c.Index() == 0 {
+			c.Replace(integer(1))
+		}
+		return true
+	}, nil)
+	if result.String() != "{1: v}" {
+		t.Errorf("Expected the key replaced, got %q", result.String())
+	}
+	result = Apply(ident("old"), func(c *Cursor) bool {
+		if c.Parent() != nil || c.Name() != "" || c.Index() != -1 {
+			t.Errorf("Expected the root to have no parent, got %T %q %d", c.Parent(), c.Name(), c.Index())
+		}
+		c.Replace(ident("new"))
+		return true
+	}, nil)
+	if result.String() != "new" {
+		t.Errorf("Expected the root replaced, got %q", result.String())
+	}
+
+	/* post returning false stops the traversal */
+	count := 0
+	Apply(program, nil, func(c *Cursor) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Errorf("Expected Apply to stop after 2 nodes, went to %d", count)
+	}
+}
+
+func TestApplyMisuse(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(*Cursor)
+		expected string
+	}{
+		{"Replace", func(c *Cursor) { c.Replace(&BreakStatement{}) },
+			"ast.Cursor.Replace: *ast.BreakStatement in *ast.InfixExpression.Right, which holds ast.Expression"},
+		{"Delete", func(c *Cursor) { c.Delete() },
+			"ast.Cursor.Delete: *ast.InfixExpression.Right is not a list"},
+		{"InsertAfter", func(c *Cursor) { c.InsertAfter(&Identifier{}) },
+			"ast.Cursor.InsertAfter: *ast.InfixExpression.Right is not a list"},
+	}
+
+	for _, tt := range tests {
+		exp := &InfixExpression{Left: &Identifier{}, Operator: "+", Right: &Identifier{}}
+		func() {
+			defer func() {
+				if r := recover(); r != tt.expected {
+					t.Errorf("%s: expected panic %q, got %v", tt.name, tt.expected, r)
+				}
+			}()
+			Apply(exp, func(c *Cursor) bool {
+				if c.Name() == "Right" {
+					tt.edit(c)
+				}
+				return true
+			}, nil)
+		}()
+	}
+
+	/* The root has no list to be deleted from */
+	func() {
+		expected := "ast.Cursor.Delete: the root is not a list"
+		defer func() {
+			if r := recover(); r != expected {
+				t.Errorf("Root: expected panic %q, got %v", expected, r)
+			}
+		}()
+		Apply(&Identifier{}, func(c *Cursor) bool {
+			c.Delete()
+			return true
+		}, nil)
+	}()
+
+	/* Only a block or another if can follow else */
+	defer func() {
+		expected := "ast.Cursor.Replace: *ast.ExpressionStatement in *ast.IfExpression.ElseBlock, which holds ast.ElseNode"
+		if r := recover(); r != expected {
+			t.Errorf("ElseBlock: expected panic %q, got %v", expected, r)
+		}
+	}()
+	ie := &IfExpression{Condition: &Boolean{}, IfBlock: &BlockStatement{}, ElseBlock: &BlockStatement{}}
+	Apply(ie, func(c *Cursor) bool {
+		if c.Name() == "ElseBlock" {
+			c.Replace(&ExpressionStatement{})
+		}
+		return true
+	}, nil)
+}
+
+func TestJSON(t *testing.T) {
+	x := &Identifier{Token: token.Token{
+		Type:    token.IDENT,
+		Literal: "x",
+		Pos:     token.Position{Offset: 1, Line: 1, Column: 2},
+		End:     token.Position{Offset: 2, Line: 1, Column: 3},
+	}, Value: "x"}
+	paren := &ParenExpression{
+		Token:      token.Token{Type: token.LPAREN, Literal: "("},
+		Expression: x,
+		Rparen: token.Token{Type: token.RPAREN, Literal: ")",
+			Pos: token.Position{Offset: 2, Line: 1, Column: 3},
+			End: token.Position{Offset: 3, Line: 1, Column: 4}},
+	}
+	program := &Program{Statements: []Statement{&ExpressionStatement{Token: paren.Token, Expression: paren}}}
+
+	data, err := json.Marshal(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := `{"kind":"ParenExpression",` +
+		`"token":{"type":"(","literal":"(","pos":{"offset":0,"line":0,"column":0},` +
+		`"end":{"offset":0,"line":0,"column":0}},` +
+		`"span":{"pos":0,"end":3},` +
+		`"expression":{"kind":"Identifier",` +
+		`"token":{"type":"IDENT","literal":"x","pos":{"offset":1,"line":1,"column":2},` +
+		`"end":{"offset":2,"line":1,"column":3}},` +
+		`"span":{"pos":1,"end":2},"value":"x"},` +
+		`"rparen":{"type":")","literal":")","pos":{"offset":2,"line":1,"column":3},` +
+		`"end":{"offset":3,"line":1,"column":4}}}`
+	if !strings.Contains(string(data), ident) {
+		t.Errorf("Expected JSON containing\n%s\ngot\n%s", ident, data)
+	}
+
+	decoded := &Program{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, program) {
+		t.Errorf("Expected the program back, got %s", decoded)
+	}
+
+	/* Tokens that weren't in the source aren't written out */
+	call := &CallExpression{Token: token.Token{Type: token.LPAREN, Literal: "("}, Function: &Identifier{Value: "f"}}
+	data, err = json.Marshal(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "rparen") {
+		t.Errorf("Expected no rparen, got\n%s", data)
+	}
+	decodedCall := &CallExpression{}
+	if err := json.Unmarshal(data, decodedCall); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedCall, call) {
+		t.Errorf("Expected the call back, got %s", decodedCall)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"kind": "Loop"}`, `Unknown node kind "Loop"`},
+		{`{"value": "x"}`, "Node has no kind"},
+		{`{"kind": "ExpressionStatement", "expression": {"kind": "BreakStatement"}}`,
+			"ExpressionStatement.Expression: A *ast.BreakStatement isn't an ast.Expression"},
+		{`{"kind": "LetStatement", "name": {"kind": "IntegerLiteral"}}`,
+			"LetStatement.Name: Expected a node of kind Identifier, got IntegerLiteral"},
+	}
+
+	for _, tt := range tests {
+		_, err := UnmarshalJSON([]byte(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("Decoding %s: expected error %q, got %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestDumps(t *testing.T) {
+	ident := func(name string) *Identifier {
+		return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+	}
+	/* (-a) * b; {"k\n": [b]} */
+	program := &Program{Statements: []Statement{
+		&ExpressionStatement{Expression: &InfixExpression{
+			Left:     &PrefixExpression{Operator: "-", Right: ident("a")},
+			Operator: "*",
+			Right:    ident("b"),
+		}},
+		&ExpressionStatement{Expression: &HashLiteral{Pairs: []HashPair{{
+			Key:   &StringLiteral{Value: "k\n"},
+			Value: &ArrayLiteral{Elements: []Expression{ident("b")}},
+		}}}},
+	}}
+
+	var sexpr bytes.Buffer
+	if err := DumpSexpr(program, &sexpr); err != nil {
+		t.Fatal(err)
+	}
+	expected := `(program
+  (expr
+    (*
+      (- a)
+      b))
+  (expr
+    (hash
+      "k\n"
+      (array b))))
+`
+	if sexpr.String() != expected {
+		t.Errorf("DumpSexpr wrong. Expected\n%s\ngot\n%s", expected, sexpr.String())
+	}
+
+	var dot bytes.Buffer
+	if err := DumpDOT(program.Statements[1], &dot); err != nil {
+		t.Fatal(err)
+	}
+	expected = `digraph AST {
+	node [shape=ellipse, fontname=monospace];
+	edge [fontname=monospace, fontsize=10];
+	n0 [label="expr"];
+	n1 [label="hash"];
+	n2 [label="\"k\\n\"", shape=box];
+	n1 -> n2 [label="Key[0]"];
+	n3 [label="array"];
+	n4 [label="b", shape=box];
+	n3 -> n4 [label="Elements[0]"];
+	n1 -> n3 [label="Value[0]"];
+	n0 -> n1 [label="Expression"];
+}
+`
+	if dot.String() != expected {
+		t.Errorf("DumpDOT wrong. Expected\n%s\ngot\n%s", expected, dot.String())
+	}
+}
+
+func TestEqualAndHash(t *testing.T) {
+	at := func(offset int) token.Position {
+		return token.Position{Offset: offset, Line: 1, Column: offset + 1}
+	}
+	/* a + b, starting at offset */
+	sum := func(offset int, a, b string) Node {
+		ident := func(name string, offset int) *Identifier {
+			return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name,
+				Pos: at(offset), End: at(offset + 1)}, Value: name}
+		}
+		return &InfixExpression{
+			Token:    token.Token{Type: token.PLUS, Literal: "+", Pos: at(offset + 2), End: at(offset + 3)},
+			Left:     ident(a, offset),
+			Operator: "+",
+			Right:    ident(b, offset+4),
+		}
+	}
+	parenthesized := &ParenExpression{
+		Token:      token.Token{Type: token.LPAREN, Literal: "("},
+		Expression: sum(1, "a", "b").(Expression),
+		Rparen:     token.Token{Type: token.RPAREN, Literal: ")"},
+	}
+
+	tests := []struct {
+		a, b         Node
+		equal        bool
+		equalIgnored bool // with IgnorePositions
+	}{
+		{sum(0, "a", "b"), sum(0, "a", "b"), true, true},
+		{sum(0, "a", "b"), sum(3, "a", "b"), false, true},
+		{sum(0, "a", "b"), parenthesized, false, true},
+		{sum(0, "a", "b"), sum(0, "a", "c"), false, false},
+		{sum(0, "a", "b"), &Identifier{Value: "a"}, false, false},
+		{nil, sum(0, "a", "b"), false, false},
+		{nil, nil, true, true},
+	}
+
+	for i, tt := range tests {
+		if got := Equal(tt.a, tt.b); got != tt.equal {
+			t.Errorf("tests[%d] - Equal wrong. Expected %t, got %t", i, tt.equal, got)
+		}
+		if got := Equal(tt.a, tt.b, IgnorePositions()); got != tt.equalIgnored {
+			t.Errorf("tests[%d] - Equal with IgnorePositions wrong. Expected %t, got %t",
+				i, tt.equalIgnored, got)
+		}
+		if got := Hash(tt.a) == Hash(tt.b); got != tt.equalIgnored {
+			t.Errorf("tests[%d] - Expected hashes to match: %t, got %t", i, tt.equalIgnored, got)
+		}
+	}
+}
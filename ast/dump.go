@@ -0,0 +1,159 @@
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/* A dumpNode is a node as it's shown by DumpDOT and DumpSexpr */
+type dumpNode struct {
+	label    string // the operator or literal, or else what sort of node it is
+	field    string // where its parent holds it, like "Left" or "Arguments[1]"
+	children []*dumpNode
+}
+
+func dumpTree(root Node) *dumpNode {
+	var stack []*dumpNode
+	var tree *dumpNode
+	Apply(root, func(c *Cursor) bool {
+		dn := &dumpNode{label: dumpLabel(c.Node()), field: c.Name()}
+		if c.Index() >= 0 {
+			dn.field += "[" + strconv.Itoa(c.Index()) + "]"
+		}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, dn)
+		} else {
+			tree = dn
+		}
+		stack = append(stack, dn)
+		return true
+	}, func(c *Cursor) bool {
+		stack = stack[:len(stack)-1]
+		return true
+	})
+	return tree
+}
+
+func dumpLabel(node Node) string {
+	switch n := node.(type) {
+	case *Program:
+		return "program"
+	case *LetStatement:
+		return "let"
+	case *ReturnStatement:
+		return "return"
+	case *ExpressionStatement:
+		return "expr"
+	case *WhileStatement:
+		return "while"
+	case *ForStatement:
+		return "for"
+	case *BlockStatement:
+		return "block"
+	case *IfExpression:
+		return "if"
+	case *FunctionLiteral:
+		return "fn"
+	case *CallExpression:
+		return "call"
+	case *ArrayLiteral:
+		return "array"
+	case *IndexExpression:
+		return "index"
+	case *HashLiteral:
+		return "hash"
+	case *PrefixExpression:
+		return n.Operator
+	case *InfixExpression:
+		return n.Operator
+	case *AssignExpression:
+		return n.Operator
+	case *ParenExpression:
+		return "paren"
+	}
+	/* Literals and identifiers, and break and continue, show as written */
+	return strings.TrimSuffix(node.String(), ";")
+}
+
+/*
+DumpDOT writes the tree under node as a Graphviz digraph, for viewing with
+something like `dot -Tsvg`. Nodes are labelled with their operator or literal
+value, and edges with the field of the parent they come from.
+*/
+func DumpDOT(node Node, w io.Writer) error {
+	var out bytes.Buffer
+	out.WriteString("digraph AST {\n")
+	out.WriteString("\tnode [shape=ellipse, fontname=monospace];\n")
+	out.WriteString("\tedge [fontname=monospace, fontsize=10];\n")
+
+	count := 0
+	var dump func(dn *dumpNode) int
+	dump = func(dn *dumpNode) int {
+		id := count
+		count++
+		shape := ""
+		if len(dn.children) == 0 {
+			shape = ", shape=box"
+		}
+		fmt.Fprintf(&out, "\tn%d [label=%s%s];\n", id, strconv.Quote(dn.label), shape)
+		for _, child := range dn.children {
+			childID := dump(child)
+			fmt.Fprintf(&out, "\tn%d -> n%d [label=%s];\n", id, childID, strconv.Quote(child.field))
+		}
+		return id
+	}
+	if node != nil {
+		dump(dumpTree(node))
+	}
+
+	out.WriteString("}\n")
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+/*
+DumpSexpr writes the tree under node as an indented S-expression, such as
+
+	(program
+	  (expr
+	    (*
+	      (- a)
+	      b)))
+
+A node whose children are all leaves fits on one line.
+*/
+func DumpSexpr(node Node, w io.Writer) error {
+	var out bytes.Buffer
+	var dump func(dn *dumpNode, indent string)
+	dump = func(dn *dumpNode, indent string) {
+		if len(dn.children) == 0 {
+			out.WriteString(dn.label)
+			return
+		}
+		out.WriteString("(" + dn.label)
+		inline := true
+		for _, child := range dn.children {
+			inline = inline && len(child.children) == 0
+		}
+		for _, child := range dn.children {
+			if inline {
+				out.WriteString(" ")
+			} else {
+				out.WriteString("\n" + indent + "  ")
+			}
+			dump(child, indent+"  ")
+		}
+		out.WriteString(")")
+	}
+	if node != nil {
+		dump(dumpTree(node), "")
+	}
+
+	out.WriteString("\n")
+	_, err := w.Write(out.Bytes())
+	return err
+}
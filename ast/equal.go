@@ -0,0 +1,201 @@
+package ast
+
+import (
+	"fmt"
+	"github.com/cowlet/moncow/token"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+)
+
+type EqualOption func(*equalConfig)
+
+type equalConfig struct {
+	ignorePositions bool
+}
+
+/*
+IgnorePositions makes Equal compare tokens by type and literal only, so that
+the same code laid out differently compares equal. Trivia are ignored too, as
+are ParenExpressions, since the shape of the tree already captures the
+grouping they give.
+*/
+func IgnorePositions() EqualOption {
+	return func(c *equalConfig) {
+		c.ignorePositions = true
+	}
+}
+
+var (
+	tokenType = reflect.TypeOf(token.Token{})
+	nodeType  = reflect.TypeOf((*Node)(nil)).Elem()
+)
+
+/* Equal reports whether two trees are the same, down to every token */
+func Equal(a, b Node, opts ...EqualOption) bool {
+	var c equalConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c.equal(reflect.ValueOf(&a).Elem(), reflect.ValueOf(&b).Elem())
+}
+
+func (c *equalConfig) equal(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if c.ignorePositions {
+			a, b = unparen(a), unparen(b)
+		}
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Elem().Type() != b.Elem().Type() {
+			return false
+		}
+		return c.equal(a.Elem(), b.Elem())
+
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !c.equal(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Struct:
+		if c.ignorePositions {
+			switch a.Type() {
+			case tokenType:
+				ta, tb := a.Interface().(token.Token), b.Interface().(token.Token)
+				return ta.Type == tb.Type && ta.Literal == tb.Literal
+			}
+		}
+		for i := 0; i < a.NumField(); i++ {
+			if !c.equal(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Float64:
+		/* NaN doesn't equal itself, but a NaN literal does */
+		return math.Float64bits(a.Float()) == math.Float64bits(b.Float())
+	}
+	return a.Interface() == b.Interface()
+}
+
+/*
+Hash gives a hash of what a tree contains, as compared by Equal with
+IgnorePositions, so it's unchanged by changes to layout or comments. The hash
+is stable, and may be saved for use by later runs.
+*/
+func Hash(node Node) uint64 {
+	h := fnv.New64a()
+	hashValue(h, reflect.ValueOf(&node).Elem())
+	return h.Sum64()
+}
+
+func hashValue(h hash.Hash64, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		v = unparen(v)
+		if v.IsNil() {
+			fmt.Fprint(h, "nil;")
+			return
+		}
+		if v.Type().Implements(nodeType) {
+			fmt.Fprintf(h, "%s{", v.Elem().Type().Name())
+			defer fmt.Fprint(h, "}")
+		}
+		hashValue(h, v.Elem())
+
+	case reflect.Slice:
+		fmt.Fprintf(h, "[%d:", v.Len())
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i))
+		}
+		fmt.Fprint(h, "]")
+
+	case reflect.Struct:
+		switch v.Type() {
+		case tokenType:
+			tok := v.Interface().(token.Token)
+			fmt.Fprintf(h, "%q%q;", tok.Type, tok.Literal)
+		default:
+			for i := 0; i < v.NumField(); i++ {
+				hashValue(h, v.Field(i))
+			}
+		}
+
+	case reflect.String:
+		fmt.Fprintf(h, "%q;", v.String())
+	case reflect.Float64:
+		fmt.Fprintf(h, "%x;", math.Float64bits(v.Float()))
+	default:
+		fmt.Fprintf(h, "%v;", v.Interface())
+	}
+}
+
+/* unparen gives the expression inside v, if v holds a *ParenExpression */
+func unparen(v reflect.Value) reflect.Value {
+	for !v.IsNil() {
+		pe, ok := v.Interface().(*ParenExpression)
+		if !ok || pe.Expression == nil {
+			break
+		}
+		v = reflect.ValueOf(&pe.Expression).Elem()
+	}
+	return v
+}
+
+/* Clone makes a deep copy of a tree, which shares nothing with the original */
+func Clone(node Node) Node {
+	v := reflect.ValueOf(&node).Elem()
+	clone := reflect.New(v.Type()).Elem()
+	cloneValue(clone, v)
+	node, _ = clone.Interface().(Node)
+	return node
+}
+
+/* cloneValue copies from into the settable value to */
+func cloneValue(to, from reflect.Value) {
+	switch from.Kind() {
+	case reflect.Interface:
+		if from.IsNil() {
+			return
+		}
+		el := reflect.New(from.Elem().Type()).Elem()
+		cloneValue(el, from.Elem())
+		to.Set(el)
+
+	case reflect.Ptr:
+		if from.IsNil() {
+			return
+		}
+		ptr := reflect.New(from.Type().Elem())
+		cloneValue(ptr.Elem(), from.Elem())
+		to.Set(ptr)
+
+	case reflect.Slice:
+		if from.IsNil() {
+			return
+		}
+		slice := reflect.MakeSlice(from.Type(), from.Len(), from.Len())
+		for i := 0; i < from.Len(); i++ {
+			cloneValue(slice.Index(i), from.Index(i))
+		}
+		to.Set(slice)
+
+	case reflect.Struct:
+		for i := 0; i < from.NumField(); i++ {
+			cloneValue(to.Field(i), from.Field(i))
+		}
+
+	default:
+		to.Set(from)
+	}
+}
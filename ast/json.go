@@ -0,0 +1,279 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/cowlet/moncow/token"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+In JSON, each node is an object with its "kind", which is the name of its Go
+type, its "token", its "span" as byte offsets, and then its fields, named as
+in Go but starting in lower case:
+
+	{"kind": "Identifier", "token": {...}, "span": {"pos": 4, "end": 5}, "value": "x"}
+
+A closing token is left out if a failed parse didn't find it. The span is only for
+the convenience of other tools, and is ignored when decoding, because it's
+worked out from the tokens.
+*/
+
+/* MarshalJSON encodes node and everything under it */
+func MarshalJSON(node Node) ([]byte, error) {
+	return json.Marshal(node)
+}
+
+/* UnmarshalJSON decodes a node of any kind, along with everything under it */
+func UnmarshalJSON(data []byte) (Node, error) {
+	return decodeNode(data)
+}
+
+var nodeKinds = map[string]reflect.Type{}
+
+func init() {
+	for _, node := range []Node{
+		&LetStatement{}, &ReturnStatement{}, &ExpressionStatement{},
+		&WhileStatement{}, &ForStatement{}, &BreakStatement{},
+		&ContinueStatement{}, &BlockStatement{},
+		&Identifier{}, &IntegerLiteral{}, &FloatLiteral{}, &StringLiteral{},
+		&Boolean{}, &PrefixExpression{}, &InfixExpression{},
+		&AssignExpression{}, &ParenExpression{}, &IfExpression{}, &FunctionLiteral{},
+		&CallExpression{}, &ArrayLiteral{}, &IndexExpression{}, &HashLiteral{},
+		&Program{},
+	} {
+		typ := reflect.TypeOf(node).Elem()
+		nodeKinds[typ.Name()] = typ
+	}
+}
+
+/* Statements */
+func (ls *LetStatement) MarshalJSON() ([]byte, error)           { return encodeStruct(ls) }
+func (ls *LetStatement) UnmarshalJSON(data []byte) error        { return decodeStruct(data, ls) }
+func (rs *ReturnStatement) MarshalJSON() ([]byte, error)        { return encodeStruct(rs) }
+func (rs *ReturnStatement) UnmarshalJSON(data []byte) error     { return decodeStruct(data, rs) }
+func (es *ExpressionStatement) MarshalJSON() ([]byte, error)    { return encodeStruct(es) }
+func (es *ExpressionStatement) UnmarshalJSON(data []byte) error { return decodeStruct(data, es) }
+func (ws *WhileStatement) MarshalJSON() ([]byte, error)         { return encodeStruct(ws) }
+func (ws *WhileStatement) UnmarshalJSON(data []byte) error      { return decodeStruct(data, ws) }
+func (fs *ForStatement) MarshalJSON() ([]byte, error)           { return encodeStruct(fs) }
+func (fs *ForStatement) UnmarshalJSON(data []byte) error        { return decodeStruct(data, fs) }
+func (bs *BreakStatement) MarshalJSON() ([]byte, error)         { return encodeStruct(bs) }
+func (bs *BreakStatement) UnmarshalJSON(data []byte) error      { return decodeStruct(data, bs) }
+func (cs *ContinueStatement) MarshalJSON() ([]byte, error)      { return encodeStruct(cs) }
+func (cs *ContinueStatement) UnmarshalJSON(data []byte) error   { return decodeStruct(data, cs) }
+func (bs *BlockStatement) MarshalJSON() ([]byte, error)         { return encodeStruct(bs) }
+func (bs *BlockStatement) UnmarshalJSON(data []byte) error      { return decodeStruct(data, bs) }
+
+/* Expressions */
+func (i *Identifier) MarshalJSON() ([]byte, error)           { return encodeStruct(i) }
+func (i *Identifier) UnmarshalJSON(data []byte) error        { return decodeStruct(data, i) }
+func (il *IntegerLiteral) MarshalJSON() ([]byte, error)      { return encodeStruct(il) }
+func (il *IntegerLiteral) UnmarshalJSON(data []byte) error   { return decodeStruct(data, il) }
+func (fl *FloatLiteral) MarshalJSON() ([]byte, error)        { return encodeStruct(fl) }
+func (fl *FloatLiteral) UnmarshalJSON(data []byte) error     { return decodeStruct(data, fl) }
+func (sl *StringLiteral) MarshalJSON() ([]byte, error)       { return encodeStruct(sl) }
+func (sl *StringLiteral) UnmarshalJSON(data []byte) error    { return decodeStruct(data, sl) }
+func (b *Boolean) MarshalJSON() ([]byte, error)              { return encodeStruct(b) }
+func (b *Boolean) UnmarshalJSON(data []byte) error           { return decodeStruct(data, b) }
+func (pe *PrefixExpression) MarshalJSON() ([]byte, error)    { return encodeStruct(pe) }
+func (pe *PrefixExpression) UnmarshalJSON(data []byte) error { return decodeStruct(data, pe) }
+func (ie *InfixExpression) MarshalJSON() ([]byte, error)     { return encodeStruct(ie) }
+func (ie *InfixExpression) UnmarshalJSON(data []byte) error  { return decodeStruct(data, ie) }
+func (ae *AssignExpression) MarshalJSON() ([]byte, error)    { return encodeStruct(ae) }
+func (ae *AssignExpression) UnmarshalJSON(data []byte) error { return decodeStruct(data, ae) }
+func (pe *ParenExpression) MarshalJSON() ([]byte, error)     { return encodeStruct(pe) }
+func (pe *ParenExpression) UnmarshalJSON(data []byte) error  { return decodeStruct(data, pe) }
+func (ie *IfExpression) MarshalJSON() ([]byte, error)        { return encodeStruct(ie) }
+func (ie *IfExpression) UnmarshalJSON(data []byte) error     { return decodeStruct(data, ie) }
+func (fl *FunctionLiteral) MarshalJSON() ([]byte, error)     { return encodeStruct(fl) }
+func (fl *FunctionLiteral) UnmarshalJSON(data []byte) error  { return decodeStruct(data, fl) }
+func (ce *CallExpression) MarshalJSON() ([]byte, error)      { return encodeStruct(ce) }
+func (ce *CallExpression) UnmarshalJSON(data []byte) error   { return decodeStruct(data, ce) }
+func (al *ArrayLiteral) MarshalJSON() ([]byte, error)        { return encodeStruct(al) }
+func (al *ArrayLiteral) UnmarshalJSON(data []byte) error     { return decodeStruct(data, al) }
+func (ie *IndexExpression) MarshalJSON() ([]byte, error)     { return encodeStruct(ie) }
+func (ie *IndexExpression) UnmarshalJSON(data []byte) error  { return decodeStruct(data, ie) }
+func (hl *HashLiteral) MarshalJSON() ([]byte, error)         { return encodeStruct(hl) }
+func (hl *HashLiteral) UnmarshalJSON(data []byte) error      { return decodeStruct(data, hl) }
+func (hp HashPair) MarshalJSON() ([]byte, error)             { return encodeStruct(&hp) }
+func (hp *HashPair) UnmarshalJSON(data []byte) error         { return decodeStruct(data, hp) }
+
+/* Program */
+func (p *Program) MarshalJSON() ([]byte, error)    { return encodeStruct(p) }
+func (p *Program) UnmarshalJSON(data []byte) error { return decodeStruct(data, p) }
+
+/* jsonName is a field's name in JSON, e.g. "ElseBlock" becomes "elseBlock" */
+func jsonName(field string) string {
+	r, size := utf8.DecodeRuneInString(field)
+	return string(unicode.ToLower(r)) + field[size:]
+}
+
+type span struct {
+	Pos int `json:"pos"`
+	End int `json:"end"`
+}
+
+/* encodeStruct encodes a node, or a HashPair, given a pointer to it */
+func encodeStruct(ptr interface{}) ([]byte, error) {
+	var out bytes.Buffer
+	v := reflect.ValueOf(ptr).Elem()
+	write := func(key string, value interface{}) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if out.Len() > 1 {
+			out.WriteString(",")
+		}
+		fmt.Fprintf(&out, "%q:", key)
+		out.Write(data)
+		return nil
+	}
+
+	out.WriteString("{")
+	if node, ok := ptr.(Node); ok {
+		write("kind", v.Type().Name())
+		if v.FieldByName("Token").IsValid() {
+			if err := write("token", v.FieldByName("Token").Interface()); err != nil {
+				return nil, err
+			}
+		}
+		write("span", span{node.Pos(), node.End()})
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+		if field.Name == "Token" || unset(value) {
+			continue
+		}
+		if err := write(jsonName(field.Name), value.Interface()); err != nil {
+			return nil, err
+		}
+	}
+	out.WriteString("}")
+	return out.Bytes(), nil
+}
+
+/*
+unset tells whether a field holds a token that wasn't in the source. It's left
+out, as its zero positions would look like real ones.
+*/
+func unset(value reflect.Value) bool {
+	tok, ok := value.Interface().(token.Token)
+	return ok && tok.Type == ""
+}
+
+/*
+decodeStruct decodes a node, or a HashPair, into the one ptr points to. The
+kind must match, and fields left out of the JSON are left as they are.
+*/
+func decodeStruct(data []byte, ptr interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(ptr).Elem()
+	if _, ok := ptr.(Node); ok {
+		kind, err := kindOf(fields)
+		if err != nil {
+			return err
+		}
+		if kind != v.Type().Name() {
+			return fmt.Errorf("Expected a node of kind %s, got %s", v.Type().Name(), kind)
+		}
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		raw, ok := fields[jsonName(name)]
+		if !ok {
+			continue
+		}
+		if err := decodeValue(raw, v.Field(i)); err != nil {
+			return fmt.Errorf("%s.%s: %s", v.Type().Name(), name, err)
+		}
+	}
+	return nil
+}
+
+func kindOf(fields map[string]json.RawMessage) (string, error) {
+	var kind string
+	if err := json.Unmarshal(fields["kind"], &kind); err != nil || kind == "" {
+		return "", fmt.Errorf("Node has no kind")
+	}
+	return kind, nil
+}
+
+/*
+decodeValue decodes into a field. The encoding/json package does that for
+everything but the fields holding interfaces, such as an Expression, which
+need the kind to know what to decode.
+*/
+func decodeValue(raw json.RawMessage, v reflect.Value) error {
+	switch {
+	case v.Kind() == reflect.Interface:
+		node, err := decodeNode(raw)
+		if err != nil {
+			return err
+		}
+		return setNode(v, node)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Interface:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(raw, &elements); err != nil {
+			return err
+		}
+		if elements == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), len(elements), len(elements)))
+		for i, el := range elements {
+			if err := decodeValue(el, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return json.Unmarshal(raw, v.Addr().Interface())
+}
+
+/* decodeNode decodes a node whose kind isn't known in advance */
+func decodeNode(data []byte) (Node, error) {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	kind, err := kindOf(fields)
+	if err != nil {
+		return nil, err
+	}
+	typ, ok := nodeKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("Unknown node kind %q", kind)
+	}
+	node := reflect.New(typ).Interface().(Node)
+	if err := json.Unmarshal(data, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func setNode(v reflect.Value, node Node) error {
+	if node == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if !reflect.TypeOf(node).AssignableTo(v.Type()) {
+		return fmt.Errorf("A %T isn't an %s", node, v.Type())
+	}
+	v.Set(reflect.ValueOf(node))
+	return nil
+}
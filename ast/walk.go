@@ -0,0 +1,156 @@
+package ast
+
+import "fmt"
+
+/*
+A Visitor's Visit method is called for each node found by Walk. If it returns
+a non-nil visitor w, Walk visits each of the node's children with w, and then
+calls w.Visit(nil).
+*/
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+/*
+Walk traverses an AST depth first, in source order. It starts by calling
+v.Visit(node), which must not be nil. Children left nil by a failed parse are
+skipped.
+*/
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	/* Statements */
+	case *LetStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkExpression(v, n.Value)
+
+	case *ReturnStatement:
+		walkExpression(v, n.Value)
+
+	case *ExpressionStatement:
+		walkExpression(v, n.Expression)
+
+	case *WhileStatement:
+		walkExpression(v, n.Condition)
+		walkBlock(v, n.Body)
+
+	case *ForStatement:
+		if n.Init != nil {
+			Walk(v, n.Init)
+		}
+		walkExpression(v, n.Condition)
+		walkExpression(v, n.Post)
+		walkBlock(v, n.Body)
+
+	case *BreakStatement, *ContinueStatement:
+		// nothing to do
+
+	case *BlockStatement:
+		walkStatements(v, n.Statements)
+
+	/* Expressions */
+	case *Identifier, *IntegerLiteral, *FloatLiteral, *StringLiteral, *Boolean:
+		// nothing to do
+
+	case *PrefixExpression:
+		walkExpression(v, n.Right)
+
+	case *InfixExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Right)
+
+	case *AssignExpression:
+		walkExpression(v, n.Target)
+		walkExpression(v, n.Value)
+
+	case *ParenExpression:
+		walkExpression(v, n.Expression)
+
+	case *IfExpression:
+		walkExpression(v, n.Condition)
+		walkBlock(v, n.IfBlock)
+		if n.ElseBlock != nil {
+			Walk(v, n.ElseBlock)
+		}
+
+	case *FunctionLiteral:
+		for _, param := range n.Parameters {
+			Walk(v, param)
+		}
+		walkBlock(v, n.Body)
+
+	case *CallExpression:
+		walkExpression(v, n.Function)
+		for _, arg := range n.Arguments {
+			walkExpression(v, arg)
+		}
+
+	case *ArrayLiteral:
+		for _, el := range n.Elements {
+			walkExpression(v, el)
+		}
+
+	case *IndexExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Index)
+
+	case *HashLiteral:
+		for _, pair := range n.Pairs {
+			walkExpression(v, pair.Key)
+			walkExpression(v, pair.Value)
+		}
+
+	/* Program */
+	case *Program:
+		walkStatements(v, n.Statements)
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkExpression(v Visitor, exp Expression) {
+	if exp != nil {
+		Walk(v, exp)
+	}
+}
+
+/* A nil *BlockStatement must be caught before it becomes a non-nil Node */
+func walkBlock(v Visitor, block *BlockStatement) {
+	if block != nil {
+		Walk(v, block)
+	}
+}
+
+func walkStatements(v Visitor, stmts []Statement) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			Walk(v, stmt)
+		}
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+/*
+Inspect traverses an AST in the same order as Walk, calling f(node) for each
+node and then f(nil) once the node's children are done. If f returns false,
+the node's children are skipped.
+*/
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/lexer"
+	"github.com/cowlet/moncow/parser"
+	"io"
+	"os"
+)
+
+var astFormats = map[string]func(ast.Node, io.Writer) error{
+	"sexpr": ast.DumpSexpr,
+	"dot":   ast.DumpDOT,
+}
+
+/*
+runAST is `moncow ast`, which prints the parse tree of a file, or of standard
+input if there's no file. It returns the exit status.
+*/
+func runAST(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ast", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "sexpr", "output format, sexpr or dot")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	dump, ok := astFormats[*format]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown format %q, expected sexpr or dot\n", *format)
+		return 2
+	}
+	if flags.NArg() > 1 {
+		fmt.Fprintln(stderr, "Expected at most one file")
+		return 2
+	}
+
+	name := "<standard input>"
+	var src []byte
+	var err error
+	if flags.NArg() == 1 {
+		name = flags.Arg(0)
+		src, err = os.ReadFile(name)
+	} else {
+		src, err = io.ReadAll(stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	p := parser.New(lexer.NewWithFilename(name, string(src)))
+	program := p.ParseProgram()
+	if diagnostics := p.Diagnostics(); len(diagnostics) != 0 {
+		for _, d := range diagnostics {
+			fmt.Fprint(stderr, d.Render(string(src)))
+		}
+		return 2
+	}
+	if err := dump(program, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
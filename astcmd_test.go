@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAST(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "moo.mc")
+	writeFile(t, file, "let x = (-a) * b;")
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{file}, "(program\n  (let\n    x\n    (*\n      (paren\n        (- a))\n      b)))\n"},
+		{[]string{"--format=sexpr", file}, "(program\n  (let\n    x\n    (*\n      (paren\n        (- a))\n      b)))\n"},
+		{[]string{"--format=dot", file}, "digraph AST {\n"},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		if status := runAST(tt.args, nil, &stdout, &stderr); status != 0 {
+			t.Fatalf("%v: expected status 0, got %d: %s", tt.args, status, stderr.String())
+		}
+		if !strings.HasPrefix(stdout.String(), tt.expected) {
+			t.Errorf("%v: expected output starting\n%s\ngot\n%s", tt.args, tt.expected, stdout.String())
+		}
+	}
+}
+
+func TestASTErrors(t *testing.T) {
+	tests := []struct {
+		args     []string
+		stdin    string
+		expected string
+	}{
+		{[]string{"--format=json"}, "x", "Unknown format \"json\", expected sexpr or dot\n"},
+		{nil, "let = 1;", "error[P0001]"},
+		{[]string{"a.mc", "b.mc"}, "", "Expected at most one file\n"},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		status := runAST(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+		if status != 2 {
+			t.Errorf("%v: expected status 2, got %d", tt.args, status)
+		}
+		if !strings.HasPrefix(stderr.String(), tt.expected) {
+			t.Errorf("%v: expected error %q, got %q", tt.args, tt.expected, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package cst
+
+import (
+	"bytes"
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/diagnostic"
+	"github.com/cowlet/moncow/lexer"
+	"github.com/cowlet/moncow/parser"
+	"github.com/cowlet/moncow/token"
+)
+
+/* An Element is either a *Node or a *Token */
+type Element interface {
+	String() string // exactly the source text the element covers
+	element()
+}
+
+/*
+A Node of the concrete syntax tree. Unlike the AST, the tree keeps every token,
+comment and run of whitespace, so printing an unmodified tree gives back the
+source byte for byte.
+*/
+type Node struct {
+	Kind     string // the ast type's name, or parser.ErrorKind
+	Children []Element
+}
+
+func (n *Node) element() {}
+func (n *Node) String() string {
+	var out bytes.Buffer
+	for _, child := range n.Children {
+		out.WriteString(child.String())
+	}
+	return out.String()
+}
+
+/* Tokens lists every token under n, in source order */
+func (n *Node) Tokens() []*Token {
+	tokens := []*Token{}
+	for _, child := range n.Children {
+		switch child := child.(type) {
+		case *Token:
+			tokens = append(tokens, child)
+		case *Node:
+			tokens = append(tokens, child.Tokens()...)
+		}
+	}
+	return tokens
+}
+
+type Token struct {
+	token.Token        // including its leading and trailing trivia
+	Text        string // as written, so a string's quotes and escapes are kept
+}
+
+func (t *Token) element() {}
+func (t *Token) String() string {
+	var out bytes.Buffer
+	for _, trivia := range t.Leading {
+		out.WriteString(trivia.Text)
+	}
+	out.WriteString(t.Text)
+	for _, trivia := range t.Trailing {
+		out.WriteString(trivia.Text)
+	}
+	return out.String()
+}
+
+/*
+Builder is a parser.SyntaxBuilder. It keeps a flat list of elements, and each
+Wrap folds the tail of that list into a new node, so the tree grows bottom up.
+*/
+type Builder struct {
+	source   string
+	elements []Element
+}
+
+func NewBuilder(source string) *Builder {
+	return &Builder{source: source}
+}
+
+func (b *Builder) Token(tok token.Token) {
+	t := &Token{Token: tok}
+	if tok.Pos.Offset <= tok.End.Offset && tok.End.Offset <= len(b.source) {
+		t.Text = b.source[tok.Pos.Offset:tok.End.Offset]
+	}
+	b.elements = append(b.elements, t)
+}
+
+func (b *Builder) Mark() int {
+	return len(b.elements) - 1
+}
+
+func (b *Builder) Wrap(mark int, kind string) {
+	if mark < 0 || mark >= len(b.elements) {
+		return
+	}
+	children := make([]Element, len(b.elements)-mark)
+	copy(children, b.elements[mark:])
+	b.elements = append(b.elements[:mark], &Node{Kind: kind, Children: children})
+}
+
+/* Tree gives the finished tree, normally a single Program node */
+func (b *Builder) Tree() *Node {
+	if len(b.elements) == 1 {
+		if node, ok := b.elements[0].(*Node); ok {
+			return node
+		}
+	}
+	return &Node{Kind: "Program", Children: b.elements}
+}
+
+/* Parse parses source into both a concrete syntax tree and an AST */
+func Parse(filename, source string) (*Node, *ast.Program, []diagnostic.Diagnostic) {
+	b := NewBuilder(source)
+	l := lexer.NewWithFilename(filename, source, lexer.WithTrivia())
+	p := parser.New(l, parser.WithSyntaxBuilder(b))
+
+	program := p.ParseProgram()
+	return b.Tree(), program, p.Diagnostics()
+}
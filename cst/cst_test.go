@@ -0,0 +1,182 @@
+package cst
+
+import (
+	"bytes"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testRoundTrip(t *testing.T, source string) bool {
+	tree, _, _ := Parse("test.mc", source)
+	if tree.String() != source {
+		t.Errorf("round trip failed. Expected %q, got %q", source, tree.String())
+		return false
+	}
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+	inputs := []string{
+		"",
+		" ",
+		"\n\n",
+		"let x = 5;",
+		"let   x=5 ;  // five\n",
+		"let x = 5;\r\nlet y = x;\r\n",
+		"a\rb",
+		"/* a /* nested */ comment */ x",
+		"// only a comment",
+		"let s = \"esc\\n\\t\\\"\\\\ \\u{1F42E}\";",
+		"let horse🐴 = 3;\t\t",
+		"if (x) {\n  y\n} else if (z) {\n  w\n}\n",
+		"fn(a, b,) { return a ** b; }(1, 2)",
+		`{"a": 1, 2: [true, false],}`,
+		"for (let i = 0; i < 10; i += 1) { if (i % 2 == 0) { continue } }",
+		"(((1 + 2)))",
+		"let = 1; let x 2; 5 +; let y = 3;",
+		"if (x) { 1",
+		"\"unterminated",
+		"/* unterminated",
+		"let x = \xff;",
+		"}}{{)(;;",
+		"a & b | c @ d",
+	}
+
+	for _, input := range inputs {
+		testRoundTrip(t, input)
+	}
+}
+
+/* Every string literal in these test files is a round trip test case */
+func TestRoundTripTestInputs(t *testing.T) {
+	files := []string{
+		filepath.Join("..", "parser", "parser_test.go"),
+		filepath.Join("..", "lexer", "lexer_test.go"),
+	}
+
+	count := 0
+	for _, file := range files {
+		f, err := goparser.ParseFile(token.NewFileSet(), file, nil, 0)
+		if err != nil {
+			t.Fatalf("could not parse %s: %s", file, err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			input, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatalf("could not unquote %s: %s", lit.Value, err)
+			}
+			count++
+			testRoundTrip(t, input)
+			return true
+		})
+	}
+	if count < 100 {
+		t.Errorf("expected at least 100 test inputs, found %d", count)
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("let x = 5; // five")
+	f.Add("if (x) { /* y */ 1")
+	f.Add("let s = \"\\u{1F42E}\r\n")
+	f.Fuzz(func(t *testing.T, source string) {
+		testRoundTrip(t, source)
+	})
+}
+
+/* shape prints the tree's nodes as Kind(...), and its tokens as their text */
+func shape(e Element) string {
+	var out bytes.Buffer
+	switch e := e.(type) {
+	case *Node:
+		out.WriteString(e.Kind + "(")
+		for i, child := range e.Children {
+			if i > 0 {
+				out.WriteString(" ")
+			}
+			out.WriteString(shape(child))
+		}
+		out.WriteString(")")
+	case *Token:
+		out.WriteString(e.Text)
+	}
+	return out.String()
+}
+
+func TestTreeShape(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", "Program()"},
+		{"let x = (1 + 2) * y;",
+			"Program(LetStatement(let x = InfixExpression(ParenExpression(( " +
+				"InfixExpression(IntegerLiteral(1) + IntegerLiteral(2)) )) * Identifier(y)) ;) )"},
+		{"f(a)[0]",
+			"Program(ExpressionStatement(IndexExpression(CallExpression(Identifier(f) ( " +
+				"Identifier(a) )) [ IntegerLiteral(0) ])) )"},
+		{`{"a": 1}`,
+			"Program(ExpressionStatement(HashLiteral({ StringLiteral(\"a\") : IntegerLiteral(1) })) )"},
+		{"{ x; y }",
+			"Program(BlockStatement({ ExpressionStatement(Identifier(x) ;) " +
+				"ExpressionStatement(Identifier(y)) }) )"},
+		{"if (a) { b } else { c }",
+			"Program(ExpressionStatement(IfExpression(if ( Identifier(a) ) " +
+				"BlockStatement({ ExpressionStatement(Identifier(b)) }) else " +
+				"BlockStatement({ ExpressionStatement(Identifier(c)) }))) )"},
+		{"while (x) { break; }",
+			"Program(WhileStatement(while ( Identifier(x) ) BlockStatement({ BreakStatement(break ;) })) )"},
+		{"x = -1",
+			"Program(ExpressionStatement(AssignExpression(Identifier(x) = " +
+				"PrefixExpression(- IntegerLiteral(1)))) )"},
+		{"let = 1; y",
+			"Program(Error(let = 1) ; ExpressionStatement(Identifier(y)) )"},
+	}
+
+	for _, tt := range tests {
+		tree, _, _ := Parse("test.mc", tt.input)
+		if actual := shape(tree); actual != tt.expected {
+			t.Errorf("for %q expected\n%s\ngot\n%s", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	source := "let s = \"a\\tb\"; // done\n"
+	tree, program, diagnostics := Parse("test.mc", source)
+	if len(diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics %v", diagnostics)
+	}
+	if program.String() != `let s = "a\tb";` {
+		t.Errorf("program wrong. Got %q", program.String())
+	}
+
+	tokens := tree.Tokens()
+	if len(tokens) != 6 {
+		t.Fatalf("expected 6 tokens, got %d", len(tokens))
+	}
+
+	str := tokens[3]
+	if str.Literal != "a\tb" || str.Text != `"a\tb"` {
+		t.Errorf("string token wrong. Got literal %q, text %q", str.Literal, str.Text)
+	}
+	semi := tokens[4]
+	if len(semi.Trailing) != 2 || semi.Trailing[1].Text != "// done" {
+		t.Errorf("semicolon's trailing trivia wrong. Got %+v", semi.Trailing)
+	}
+	if semi.Text != ";" {
+		t.Errorf("semicolon's text wrong. Got %q", semi.Text)
+	}
+	eof := tokens[5]
+	if len(eof.Leading) != 1 || eof.Leading[0].Text != "\n" || eof.Text != "" {
+		t.Errorf("EOF token wrong. Got %+v", eof)
+	}
+}
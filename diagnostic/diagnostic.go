@@ -0,0 +1,164 @@
+package diagnostic
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cowlet/moncow/token"
+	"strings"
+	"unicode/utf8"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+	Note
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Error:
+		return "error"
+	case Warning:
+		return "warning"
+	case Note:
+		return "note"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+/* Code is a stable identifier for a kind of problem, e.g. "P0001" */
+type Code string
+
+/* Span covers the source from Start up to, but not including, End */
+type Span struct {
+	Start token.Position
+	End   token.Position
+}
+
+/* TokenSpan covers the source text of a single token */
+func TokenSpan(tok token.Token) Span {
+	if tok.End.Line != 0 {
+		return Span{Start: tok.Pos, End: tok.End}
+	}
+	end := tok.Pos
+	end.Offset += len(tok.Literal)
+	end.Column += utf8.RuneCountInString(tok.Literal)
+	return Span{Start: tok.Pos, End: end}
+}
+
+type Diagnostic struct {
+	Span     Span
+	Severity Severity
+	Code     Code
+	Message  string
+
+	Expected []token.TokenType // token types that would have been accepted
+	Found    token.TokenType   // token type actually seen, if relevant
+	Notes    []string
+}
+
+func Errorf(code Code, span Span, format string, a ...interface{}) Diagnostic {
+	return Diagnostic{
+		Span:     span,
+		Severity: Error,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+	}
+}
+
+/* String gives the one-line "file:line:col: message" form */
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Span.Start, d.Message)
+}
+
+/*
+Render gives a multi-line report quoting the offending line of source, with
+the span underlined by carets:
+
+	error[P0001]: Expected token type IDENT, got = instead
+	 --> moo.mc:1:5
+	  |
+	1 | let = 5;
+	  |     ^
+	  = expected IDENT, found =
+*/
+func (d Diagnostic) Render(source string) string {
+	var out bytes.Buffer
+
+	lineNum := fmt.Sprintf("%d", d.Span.Start.Line)
+	gutter := strings.Repeat(" ", len(lineNum))
+
+	out.WriteString(d.Severity.String())
+	if d.Code != "" {
+		out.WriteString("[" + string(d.Code) + "]")
+	}
+	out.WriteString(": " + d.Message + "\n")
+	out.WriteString(gutter + "--> " + d.Span.Start.String() + "\n")
+
+	if line, ok := sourceLine(source, d.Span.Start); ok {
+		out.WriteString(gutter + " |\n")
+		out.WriteString(lineNum + " | " + line + "\n")
+		out.WriteString(gutter + " | " + underline(line, d.Span) + "\n")
+	}
+
+	if len(d.Expected) > 0 {
+		expected := []string{}
+		for _, tt := range d.Expected {
+			expected = append(expected, string(tt))
+		}
+		out.WriteString(gutter + " = expected " + strings.Join(expected, " or "))
+		if d.Found != "" {
+			out.WriteString(", found " + string(d.Found))
+		}
+		out.WriteString("\n")
+	}
+	for _, note := range d.Notes {
+		out.WriteString(gutter + " = note: " + note + "\n")
+	}
+	return out.String()
+}
+
+/* sourceLine finds the whole line containing pos, without its line break */
+func sourceLine(source string, pos token.Position) (string, bool) {
+	if pos.Offset < 0 || pos.Offset > len(source) {
+		return "", false
+	}
+	start := strings.LastIndexByte(source[:pos.Offset], '\n') + 1
+	end := strings.IndexByte(source[pos.Offset:], '\n')
+	if end < 0 {
+		end = len(source)
+	} else {
+		end += pos.Offset
+	}
+	return strings.TrimRight(source[start:end], "\r"), true
+}
+
+/* underline puts carets under the span, stopping at the end of the line */
+func underline(line string, span Span) string {
+	var out bytes.Buffer
+
+	runes := []rune(line)
+	start := span.Start.Column - 1
+	if start > len(runes) {
+		start = len(runes)
+	}
+	for _, r := range runes[:start] {
+		// copy tabs so the carets line up however the terminal shows them
+		if r == '\t' {
+			out.WriteRune('\t')
+		} else {
+			out.WriteRune(' ')
+		}
+	}
+
+	width := 1
+	if span.End.Line == span.Start.Line && span.End.Column > span.Start.Column {
+		width = span.End.Column - span.Start.Column
+	} else if span.End.Line > span.Start.Line && len(runes) > start {
+		width = len(runes) - start
+	}
+	out.WriteString(strings.Repeat("^", width))
+	return out.String()
+}
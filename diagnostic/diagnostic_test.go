@@ -0,0 +1,82 @@
+package diagnostic
+
+import (
+	"github.com/cowlet/moncow/token"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	tok := token.Token{
+		Type:    token.ASSIGN,
+		Literal: "=",
+		Pos:     token.Position{Filename: "moo.mc", Offset: 4, Line: 1, Column: 5},
+	}
+	d := Errorf("P0001", TokenSpan(tok), "Expected token type %s, got %s instead",
+		token.IDENT, tok.Type)
+
+	expected := "moo.mc:1:5: Expected token type IDENT, got = instead"
+	if d.String() != expected {
+		t.Errorf("d.String() wrong. Expected %q, got %q", expected, d.String())
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		source   string
+		tok      token.Token
+		notes    []string
+		expected string
+	}{
+		{
+			"let x = 5;\nlet = 5;\n",
+			token.Token{Type: token.ASSIGN, Literal: "=",
+				Pos: token.Position{Filename: "moo.mc", Offset: 15, Line: 2, Column: 5}},
+			nil,
+			`error[P0001]: Expected token type IDENT, got = instead
+ --> moo.mc:2:5
+  |
+2 | let = 5;
+  |     ^
+  = expected IDENT, found =
+`,
+		},
+		{
+			"\tlet 🐴🐴 = moo\r\n",
+			token.Token{Type: token.IDENT, Literal: "moo",
+				Pos: token.Position{Offset: 18, Line: 1, Column: 11}},
+			[]string{"a note"},
+			"error[P0001]: Expected token type IDENT, got IDENT instead\n" +
+				" --> 1:11\n" +
+				"  |\n" +
+				"1 | \tlet 🐴🐴 = moo\n" +
+				"  | \t         ^^^\n" +
+				"  = expected IDENT, found IDENT\n" +
+				"  = note: a note\n",
+		},
+		{
+			"(1 + 2",
+			token.Token{Type: token.EOF, Literal: "",
+				Pos: token.Position{Offset: 6, Line: 1, Column: 7}},
+			nil,
+			"error[P0001]: Expected token type IDENT, got EOF instead\n" +
+				" --> 1:7\n" +
+				"  |\n" +
+				"1 | (1 + 2\n" +
+				"  |       ^\n" +
+				"  = expected IDENT, found EOF\n",
+		},
+	}
+
+	for _, tt := range tests {
+		d := Errorf("P0001", TokenSpan(tt.tok), "Expected token type %s, got %s instead",
+			token.IDENT, tt.tok.Type)
+		d.Expected = []token.TokenType{token.IDENT}
+		d.Found = tt.tok.Type
+		d.Notes = tt.notes
+
+		actual := d.Render(tt.source)
+		if actual != tt.expected {
+			t.Errorf("Render wrong. Expected\n%s\ngot\n%s", tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Package diff compares texts line by line and prints their differences in
+unified diff format.
+*/
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/* Lines of unchanged context shown around each change */
+const contextLines = 3
+
+type edit struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+/*
+Unified compares a and b line by line, using a shortest edit script, and
+prints the differences in unified diff format. name is the file a and b are
+versions of.
+*/
+func Unified(name, a, b string) string {
+	ops := editScript(splitLines(a), splitLines(b))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s.orig\n+++ %s\n", name, name)
+	for start := 0; start < len(ops); {
+		/* Find the next change, and extend its hunk while changes are close */
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		end := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end > 2*contextLines {
+				break
+			}
+		}
+
+		from, to := first-contextLines, end+contextLines
+		if from < start {
+			from = start
+		}
+		if to > len(ops) {
+			to = len(ops)
+		}
+		writeHunk(&out, ops, from, to)
+		start = to
+	}
+	return out.String()
+}
+
+func writeHunk(out *bytes.Buffer, ops []edit, from, to int) {
+	/* Line numbers in a and b where the hunk starts */
+	aLine, bLine := 1, 1
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			aLine++
+		}
+		if op.kind != '-' {
+			bLine++
+		}
+	}
+	aCount, bCount := 0, 0
+	for _, op := range ops[from:to] {
+		if op.kind != '+' {
+			aCount++
+		}
+		if op.kind != '-' {
+			bCount++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(aLine, aCount), hunkRange(bLine, bCount))
+	for _, op := range ops[from:to] {
+		out.WriteByte(op.kind)
+		out.WriteString(op.line)
+		if len(op.line) == 0 || op.line[len(op.line)-1] != '\n' {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+/* splitLines keeps each line's newline, so a missing final one shows up */
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+/* An empty range names the line before it, as diff -u does */
+func hunkRange(line, count int) string {
+	if count == 0 {
+		line--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+/*
+editScript finds a shortest edit script from a to b with Myers' algorithm, in
+its linear space form, so that large files can be compared. Lines in common at
+either end are matched up first, and what's left is split at the middle of an
+optimal path, and each half diffed in turn. Each run of changes lists its
+removed lines before its added ones.
+*/
+func editScript(a, b []string) []edit {
+	ops := appendDiff(make([]edit, 0, len(a)+len(b)), a, b)
+	for start := 0; start < len(ops); start++ {
+		if ops[start].kind == ' ' {
+			continue
+		}
+		end := start
+		for end < len(ops) && ops[end].kind != ' ' {
+			end++
+		}
+		run := ops[start:end]
+		sort.SliceStable(run, func(i, j int) bool {
+			return run[i].kind == '-' && run[j].kind == '+'
+		})
+		start = end
+	}
+	return ops
+}
+
+func appendDiff(ops []edit, a, b []string) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, edit{' ', a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			ops = append(ops, edit{'+', line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, edit{'-', line})
+		}
+	default:
+		x, y, u, v := middleSnake(a, b)
+		ops = appendDiff(ops, a[:x], b[:y])
+		for _, line := range a[x:u] {
+			ops = append(ops, edit{' ', line})
+		}
+		ops = appendDiff(ops, a[u:], b[v:])
+	}
+
+	for _, line := range common {
+		ops = append(ops, edit{' ', line})
+	}
+	return ops
+}
+
+/*
+middleSnake finds the run of matching lines, from (x, y) to (u, v), in the
+middle of a shortest edit script, by searching forwards from the start and
+backwards from the end at once until the two meet. It's never at either corner
+when a and b differ at both ends, so each half is smaller than the whole.
+
+The searches always meet within (n + m + 1) / 2 steps. Were they not to, the
+empty run at (n, 0) is given, which splits the diff into removing all of a and
+adding all of b: longer than need be, but still correct.
+*/
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	limit := (n + m + 1) / 2
+
+	/*
+		forward[k] is the furthest x reached on diagonal k, where x - y = k, and
+		backward[k] the least x reached going back. They're offset to allow for
+		negative diagonals.
+	*/
+	offset := limit + n + m + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	forward[offset+1] = 0
+	backward[offset+delta-1] = n
+
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			if odd && k >= delta-(d-1) && k <= delta+(d-1) && u >= backward[offset+k] {
+				return x, y, u, v
+			}
+		}
+
+		for k := -d; k <= d; k += 2 {
+			diagonal := k + delta
+			if k == d || (k != -d && backward[offset+diagonal-1] < backward[offset+diagonal+1]) {
+				u = backward[offset+diagonal-1]
+			} else {
+				u = backward[offset+diagonal+1] - 1
+			}
+			v = u - diagonal
+			x, y = u, v
+			for x > 0 && y > 0 && a[x-1] == b[y-1] {
+				x--
+				y--
+			}
+			backward[offset+diagonal] = x
+			if !odd && diagonal >= -d && diagonal <= d && x <= forward[offset+diagonal] {
+				return x, y, u, v
+			}
+		}
+	}
+	return n, 0, n, 0
+}
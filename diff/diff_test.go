@@ -0,0 +1,97 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n"
+	expected := "--- f.orig\n+++ f\n" +
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+		"@@ -12,4 +12,3 @@\n 12\n 13\n 14\n-15\n"
+	if got := Unified("f", a, b); got != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, got)
+	}
+
+	expected = "--- f.orig\n+++ f\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n"
+	if got := Unified("f", "x", "x\n"); got != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+/* TestEditScript checks editScript against a longest common subsequence table */
+func TestEditScript(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		out := make([]string, r.Intn(12))
+		for i := range out {
+			out[i] = string(rune('a' + r.Intn(4)))
+		}
+		return out
+	}
+
+	for i := 0; i < 2000; i++ {
+		a, b := lines(), lines()
+		ops := editScript(a, b)
+		var gotA, gotB []string
+		kept := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind == ' ' {
+				kept++
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("Diff of %q and %q doesn't give them back: %v", a, b, ops)
+		}
+		if expected := lcsLength(a, b); kept != expected {
+			t.Fatalf("Diff of %q and %q isn't shortest. Expected %d lines kept, got %d", a, b, expected, kept)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+/* TestLargeFiles would need gigabytes for a table of every pair of lines */
+func TestLargeFiles(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&a, "line %d\n", i)
+		if i%1000 == 0 {
+			fmt.Fprintf(&b, "changed %d\n", i)
+		} else {
+			fmt.Fprintf(&b, "line %d\n", i)
+		}
+	}
+	diff := Unified("f", a.String(), b.String())
+	if got := strings.Count(diff, "\n+changed"); got != 100 {
+		t.Errorf("Expected 100 changed lines, got %d", got)
+	}
+}
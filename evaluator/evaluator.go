@@ -0,0 +1,619 @@
+package evaluator
+
+import (
+	"fmt"
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/object"
+	"math"
+	"strings"
+)
+
+/* There is only ever one of each of these, so compare by pointer */
+var (
+	NULL     = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
+)
+
+func Eval(node ast.Node, env *object.Environment) object.Object {
+	switch node := node.(type) {
+	/* Statements */
+	case *ast.Program:
+		return evalProgram(node, env)
+	case *ast.BlockStatement:
+		return evalBlockStatement(node, env)
+	case *ast.ExpressionStatement:
+		return Eval(node.Expression, env)
+	case *ast.LetStatement:
+		val := evalOptional(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		env.Set(node.Name.Value, val)
+		return val
+	case *ast.ReturnStatement:
+		val := evalOptional(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return &object.ReturnValue{Value: val}
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
+
+	/* Expressions */
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}
+	case *ast.Boolean:
+		return nativeBoolToBooleanObject(node.Value)
+	case *ast.Identifier:
+		return evalIdentifier(node, env)
+	case *ast.PrefixExpression:
+		right := Eval(node.Right, env)
+		if isError(right) {
+			return right
+		}
+		return evalPrefixExpression(node.Operator, right)
+	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
+		left := Eval(node.Left, env)
+		if isError(left) {
+			return left
+		}
+		right := Eval(node.Right, env)
+		if isError(right) {
+			return right
+		}
+		return evalInfixExpression(node.Operator, left, right)
+	case *ast.ParenExpression:
+		return Eval(node.Expression, env)
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
+	case *ast.IfExpression:
+		return evalIfExpression(node, env)
+	case *ast.FunctionLiteral:
+		return &object.Function{Parameters: node.Parameters, Body: node.Body, Env: env}
+	case *ast.ArrayLiteral:
+		elements := evalExpressions(node.Elements, env)
+		if len(elements) == 1 && isError(elements[0]) {
+			return elements[0]
+		}
+		return &object.Array{Elements: elements}
+	case *ast.HashLiteral:
+		return evalHashLiteral(node, env)
+	case *ast.IndexExpression:
+		left := Eval(node.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := Eval(node.Index, env)
+		if isError(index) {
+			return index
+		}
+		return evalIndexExpression(left, index)
+	case *ast.CallExpression:
+		function := Eval(node.Function, env)
+		if isError(function) {
+			return function
+		}
+		args := evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+		return applyFunction(function, args)
+	}
+
+	return newError("Cannot evaluate %T", node)
+}
+
+/* evalOptional evaluates an expression that the parser may have left out */
+func evalOptional(exp ast.Expression, env *object.Environment) object.Object {
+	if exp == nil {
+		return NULL
+	}
+	return Eval(exp, env)
+}
+
+func evalProgram(program *ast.Program, env *object.Environment) object.Object {
+	var result object.Object = NULL
+
+	for _, statement := range program.Statements {
+		result = Eval(statement, env)
+
+		switch result := result.(type) {
+		case *object.ReturnValue:
+			return result.Value
+		case *object.Error:
+			return result
+		}
+	}
+	return result
+}
+
+func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+	var result object.Object = NULL
+
+	for _, statement := range block.Statements {
+		result = Eval(statement, env)
+
+		/*
+			Leave ReturnValue wrapped so enclosing blocks stop too, and pass
+			break and continue up to the enclosing loop
+		*/
+		if result == BREAK || result == CONTINUE {
+			return result
+		}
+		if result != nil {
+			rt := result.Type()
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+				return result
+			}
+		}
+	}
+	return result
+}
+
+/* Loops evaluate to null, unless a return or an error stops them */
+func evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(ws.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return NULL
+		}
+		if result, stop := evalLoopBody(ws.Body, env); stop {
+			return result
+		}
+	}
+}
+
+func evalForStatement(fs *ast.ForStatement, env *object.Environment) object.Object {
+	if fs.Init != nil {
+		init := Eval(fs.Init, env)
+		if isError(init) {
+			return init
+		}
+	}
+	for {
+		if fs.Condition != nil {
+			condition := Eval(fs.Condition, env)
+			if isError(condition) {
+				return condition
+			}
+			if !isTruthy(condition) {
+				return NULL
+			}
+		}
+		if result, stop := evalLoopBody(fs.Body, env); stop {
+			return result
+		}
+		if fs.Post != nil {
+			post := Eval(fs.Post, env)
+			if isError(post) {
+				return post
+			}
+		}
+	}
+}
+
+/* evalLoopBody runs one iteration, and says whether the loop should stop */
+func evalLoopBody(body *ast.BlockStatement, env *object.Environment) (object.Object, bool) {
+	result := Eval(body, env)
+	if result == BREAK {
+		return NULL, true
+	}
+	if isError(result) || (result != nil && result.Type() == object.RETURN_VALUE_OBJ) {
+		return result, true
+	}
+	return nil, false
+}
+
+func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
+	val, ok := env.Get(node.Value)
+	if !ok {
+		return newError("Identifier not found: %s", node.Value)
+	}
+	return val
+}
+
+func evalPrefixExpression(operator string, right object.Object) object.Object {
+	switch operator {
+	case "!":
+		return nativeBoolToBooleanObject(!isTruthy(right))
+	case "-":
+		return evalMinusPrefixOperatorExpression(right)
+	}
+	return newError("Unknown operator: %s%s", operator, right.Type())
+}
+
+func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	}
+	return newError("Unknown operator: -%s", right.Type())
+}
+
+func evalInfixExpression(operator string, left, right object.Object) object.Object {
+	switch {
+	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
+		return evalIntegerInfixExpression(operator, left, right)
+	case isNumeric(left) && isNumeric(right):
+		/* Mixed arithmetic promotes the integer side to a float */
+		return evalFloatInfixExpression(operator, toFloat(left), toFloat(right))
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
+		return evalStringInfixExpression(operator, left, right)
+	case left.Type() != right.Type():
+		return newError("Type mismatch: %s %s %s",
+			left.Type(), operator, right.Type())
+	case operator == "==":
+		return nativeBoolToBooleanObject(left == right)
+	case operator == "!=":
+		return nativeBoolToBooleanObject(left != right)
+	}
+	return newError("Unknown operator: %s %s %s",
+		left.Type(), operator, right.Type())
+}
+
+func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
+	l := left.(*object.Integer).Value
+	r := right.(*object.Integer).Value
+
+	switch operator {
+	case "+":
+		return &object.Integer{Value: l + r}
+	case "-":
+		return &object.Integer{Value: l - r}
+	case "*":
+		return &object.Integer{Value: l * r}
+	case "/":
+		if r == 0 {
+			return newError("Division by zero: %d / %d", l, r)
+		}
+		return &object.Integer{Value: l / r}
+	case "%":
+		if r == 0 {
+			return newError("Division by zero: %d %% %d", l, r)
+		}
+		return &object.Integer{Value: l % r}
+	case "**":
+		if r < 0 {
+			/* A negative power is a fraction, so give a float */
+			return &object.Float{Value: math.Pow(float64(l), float64(r))}
+		}
+		return &object.Integer{Value: integerPower(l, r)}
+	case "<":
+		return nativeBoolToBooleanObject(l < r)
+	case ">":
+		return nativeBoolToBooleanObject(l > r)
+	case "<=":
+		return nativeBoolToBooleanObject(l <= r)
+	case ">=":
+		return nativeBoolToBooleanObject(l >= r)
+	case "==":
+		return nativeBoolToBooleanObject(l == r)
+	case "!=":
+		return nativeBoolToBooleanObject(l != r)
+	}
+	return newError("Unknown operator: %s %s %s",
+		left.Type(), operator, right.Type())
+}
+
+func evalFloatInfixExpression(operator string, l, r float64) object.Object {
+	switch operator {
+	case "+":
+		return &object.Float{Value: l + r}
+	case "-":
+		return &object.Float{Value: l - r}
+	case "*":
+		return &object.Float{Value: l * r}
+	case "/":
+		return &object.Float{Value: l / r}
+	case "%":
+		return &object.Float{Value: math.Mod(l, r)}
+	case "**":
+		return &object.Float{Value: math.Pow(l, r)}
+	case "<":
+		return nativeBoolToBooleanObject(l < r)
+	case ">":
+		return nativeBoolToBooleanObject(l > r)
+	case "<=":
+		return nativeBoolToBooleanObject(l <= r)
+	case ">=":
+		return nativeBoolToBooleanObject(l >= r)
+	case "==":
+		return nativeBoolToBooleanObject(l == r)
+	case "!=":
+		return nativeBoolToBooleanObject(l != r)
+	}
+	return newError("Unknown operator: %s %s %s",
+		object.FLOAT_OBJ, operator, object.FLOAT_OBJ)
+}
+
+/* integerPower works by repeated squaring, for exponent >= 0 */
+func integerPower(base, exponent int64) int64 {
+	result := int64(1)
+	for exponent > 0 {
+		if exponent&1 == 1 {
+			result *= base
+		}
+		base *= base
+		exponent >>= 1
+	}
+	return result
+}
+
+/* && and || only evaluate their right operand if they need to */
+func evalLogicalExpression(ie *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(ie.Left, env)
+	if isError(left) {
+		return left
+	}
+	if ie.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if ie.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+
+	right := Eval(ie.Right, env)
+	if isError(right) {
+		return right
+	}
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
+func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
+	l := left.(*object.String).Value
+	r := right.(*object.String).Value
+
+	switch operator {
+	case "+":
+		return &object.String{Value: l + r}
+	case "==":
+		return nativeBoolToBooleanObject(l == r)
+	case "!=":
+		return nativeBoolToBooleanObject(l != r)
+	}
+	return newError("Unknown operator: %s %s %s",
+		left.Type(), operator, right.Type())
+}
+
+/* An assignment evaluates to the value assigned */
+func evalAssignExpression(ae *ast.AssignExpression, env *object.Environment) object.Object {
+	switch target := ast.Unparen(ae.Target).(type) {
+	case *ast.Identifier:
+		val := Eval(ae.Value, env)
+		if isError(val) {
+			return val
+		}
+		if ae.Operator != "=" {
+			current := evalIdentifier(target, env)
+			if isError(current) {
+				return current
+			}
+			val = evalCompoundOperator(ae.Operator, current, val)
+			if isError(val) {
+				return val
+			}
+		}
+		if !env.Assign(target.Value, val) {
+			return newError("Identifier not found: %s", target.Value)
+		}
+		return val
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+		val := Eval(ae.Value, env)
+		if isError(val) {
+			return val
+		}
+		if ae.Operator != "=" {
+			val = evalCompoundOperator(ae.Operator, evalIndexExpression(left, index), val)
+			if isError(val) {
+				return val
+			}
+		}
+		return evalIndexAssignment(left, index, val)
+	}
+	return newError("Cannot assign to %s", ae.Target)
+}
+
+/* evalCompoundOperator applies the operator in "+=", "-=" and the rest */
+func evalCompoundOperator(operator string, current, val object.Object) object.Object {
+	if isError(current) {
+		return current
+	}
+	return evalInfixExpression(strings.TrimSuffix(operator, "="), current, val)
+}
+
+func evalIndexAssignment(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			break
+		}
+		/* Unlike reading, writing outside the array is an error */
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError("Index out of range: %d", idx.Value)
+		}
+		left.Elements[idx.Value] = val
+		return val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("Unusable as hash key: %s", index.Type())
+		}
+		left.Set(key.HashKey(), object.HashPair{Key: index, Value: val})
+		return val
+	}
+	return newError("Index assignment not supported: %s[%s]", left.Type(), index.Type())
+}
+
+func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := Eval(ie.Condition, env)
+	if isError(condition) {
+		return condition
+	}
+
+	if isTruthy(condition) {
+		return Eval(ie.IfBlock, env)
+	} else if ie.ElseBlock != nil {
+		return Eval(ie.ElseBlock, env)
+	}
+	return NULL
+}
+
+/* evalExpressions stops at the first error, and returns only that */
+func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
+	result := []object.Object{}
+
+	for _, e := range exps {
+		evaluated := Eval(e, env)
+		if isError(evaluated) {
+			return []object.Object{evaluated}
+		}
+		result = append(result, evaluated)
+	}
+	return result
+}
+
+func evalIndexExpression(left, index object.Object) object.Object {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.HASH_OBJ:
+		return evalHashIndexExpression(left, index)
+	}
+	return newError("Index operator not supported: %s[%s]", left.Type(), index.Type())
+}
+
+/* An index outside the array gives null */
+func evalArrayIndexExpression(array, index object.Object) object.Object {
+	elements := array.(*object.Array).Elements
+	idx := index.(*object.Integer).Value
+
+	if idx < 0 || idx >= int64(len(elements)) {
+		return NULL
+	}
+	return elements[idx]
+}
+
+/* A missing key gives null, like an index outside an array */
+func evalHashIndexExpression(hash, index object.Object) object.Object {
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return newError("Unusable as hash key: %s", index.Type())
+	}
+	pair, ok := hash.(*object.Hash).Pairs[key.HashKey()]
+	if !ok {
+		return NULL
+	}
+	return pair.Value
+}
+
+func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+	hash := object.NewHash()
+
+	for _, p := range node.Pairs {
+		key := Eval(p.Key, env)
+		if isError(key) {
+			return key
+		}
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return newError("Unusable as hash key: %s", key.Type())
+		}
+		value := Eval(p.Value, env)
+		if isError(value) {
+			return value
+		}
+		hash.Set(hashKey.HashKey(), object.HashPair{Key: key, Value: value})
+	}
+	return hash
+}
+
+func applyFunction(fn object.Object, args []object.Object) object.Object {
+	function, ok := fn.(*object.Function)
+	if !ok {
+		return newError("Not a function: %s", fn.Type())
+	}
+	if len(args) != len(function.Parameters) {
+		return newError("Wrong number of arguments: expected %d, got %d",
+			len(function.Parameters), len(args))
+	}
+
+	env := object.NewEnclosedEnvironment(function.Env)
+	for i, param := range function.Parameters {
+		env.Set(param.Value, args[i])
+	}
+
+	evaluated := Eval(function.Body, env)
+	/* Unwrap, so a return only leaves the function it's in */
+	if rv, ok := evaluated.(*object.ReturnValue); ok {
+		return rv.Value
+	}
+	return evaluated
+}
+
+/* Helper functions */
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return TRUE
+	}
+	return FALSE
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj {
+	case NULL, FALSE:
+		return false
+	}
+	return true
+}
+
+func isNumeric(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func isError(obj object.Object) bool {
+	return obj != nil && obj.Type() == object.ERROR_OBJ
+}
@@ -0,0 +1,634 @@
+package evaluator
+
+import (
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/lexer"
+	"github.com/cowlet/moncow/object"
+	"github.com/cowlet/moncow/parser"
+	"github.com/cowlet/moncow/token"
+	"testing"
+)
+
+func testEval(t *testing.T, input string) object.Object {
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, msg := range p.Errors() {
+			t.Errorf("parser error: %q", msg)
+		}
+		t.FailNow()
+	}
+	env := object.NewEnvironment()
+
+	return Eval(program, env)
+}
+
+func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
+	result, ok := obj.(*object.Integer)
+	if !ok {
+		t.Errorf("object is not Integer. Got %T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value. Expected %d, got %d",
+			expected, result.Value)
+		return false
+	}
+	return true
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. Got %T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value. Expected %f, got %f",
+			expected, result.Value)
+		return false
+	}
+	return true
+}
+
+func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
+	result, ok := obj.(*object.Boolean)
+	if !ok {
+		t.Errorf("object is not Boolean. Got %T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value. Expected %t, got %t",
+			expected, result.Value)
+		return false
+	}
+	return true
+}
+
+func testNullObject(t *testing.T, obj object.Object) bool {
+	if obj != NULL {
+		t.Errorf("object is not NULL. Got %T (%+v)", obj, obj)
+		return false
+	}
+	return true
+}
+
+func testObject(t *testing.T, obj object.Object, expected interface{}) bool {
+	switch v := expected.(type) {
+	case int:
+		return testIntegerObject(t, obj, int64(v))
+	case float64:
+		return testFloatObject(t, obj, v)
+	case bool:
+		return testBooleanObject(t, obj, v)
+	case nil:
+		return testNullObject(t, obj)
+	}
+	t.Errorf("type %T not handled", expected)
+	return false
+}
+
+func TestEvalNumericExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"5", 5},
+		{"10", 10},
+		{"-5", -5},
+		{"--10", 10},
+		{"5 + 5 + 5 + 5 - 10", 10},
+		{"2 * 2 * 2 * 2 * 2", 32},
+		{"-50 + 100 + -50", 0},
+		{"50 / 2 * 2 + 10", 60},
+		{"7 / 2", 3},
+		{"3 * (3 * 3) + 10", 37},
+		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"2.5", 2.5},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3.0},
+		{"7.0 / 2", 3.5},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"2 * (1.25 - 1)", 0.5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestEvalBooleanExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"1 < 2", true},
+		{"1 > 2", false},
+		{"1 == 1", true},
+		{"1 != 1", false},
+		{"1 == 1.0", true},
+		{"0.5 < 1", true},
+		{"2.5 > 2.5", false},
+		{"1.5 != 1.5", false},
+		{"true == true", true},
+		{"true != false", true},
+		{"(1 < 2) == true", true},
+		{"(1 > 2) == true", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestBangOperator(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"!true", false},
+		{"!false", true},
+		{"!5", false},
+		{"!0.5", false},
+		{"!!true", true},
+		{"!!5", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestIfElseExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"if (true) { 10 }", 10},
+		{"if (false) { 10 }", nil},
+		{"if (1) { 10 }", 10},
+		{"if (1 < 2) { 10 }", 10},
+		{"if (1 > 2) { 10 }", nil},
+		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (1.5 < 2) { 10.5 } else { 20 }", 10.5},
+		{"if (1 > 2) { 10 } else if (2 > 1) { 20 } else { 30 }", 20},
+		{"if (1 > 2) { 10 } else if (2 > 3) { 20 } else { 30 }", 30},
+		{"if (1 > 2) { 10 } else if (2 > 3) { 20 }", nil},
+		{"let f = fn(x) { if (x < 0) { return -1; } else if (x == 0) { return 0; } 1 }; f(0)", 0},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestReturnStatements(t *testing.T) {
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.ReturnStatement{
+				Token: token.Token{Type: token.RETURN, Literal: "return"},
+				Value: &ast.IntegerLiteral{
+					Token: token.Token{Type: token.INT, Literal: "10"},
+					Value: 10,
+				},
+			},
+			&ast.ExpressionStatement{
+				Token: token.Token{Type: token.INT, Literal: "9"},
+				Expression: &ast.IntegerLiteral{
+					Token: token.Token{Type: token.INT, Literal: "9"},
+					Value: 9,
+				},
+			},
+		},
+	}
+	testIntegerObject(t, Eval(program, object.NewEnvironment()), 10)
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"return 10;", 10},
+		{"return 10; 9;", 10},
+		{"return 2 * 5.5; 9;", 11.0},
+		{"9; return 2 * 5; 9;", 10},
+		{"return;", nil},
+		{"if (10 > 1) { if (10 > 1) { return 10; } return 1; }", 10},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestLetStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 5; a;", 5},
+		{"let a = 5 * 5; a;", 25},
+		{"let a = 5; let b = a; b;", 5},
+		{"let a = 5; let b = a; let c = a + b + 5; c;", 15},
+		{"let a = 2.5; let b = a * 2; b", 5.0},
+		{"let a = 1 < 2; a", true},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+}
+
+func TestErrorHandling(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"5 + true;", "Type mismatch: INTEGER + BOOLEAN"},
+		{"5.5 + true; 5;", "Type mismatch: FLOAT + BOOLEAN"},
+		{"-true", "Unknown operator: -BOOLEAN"},
+		{"true + false;", "Unknown operator: BOOLEAN + BOOLEAN"},
+		{"5; true + false; 5", "Unknown operator: BOOLEAN + BOOLEAN"},
+		{"if (10 > 1) { true + false; }", "Unknown operator: BOOLEAN + BOOLEAN"},
+		{"moo", "Identifier not found: moo"},
+		{"1 / 0", "Division by zero: 1 / 0"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. Got %T (%+v)",
+				evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expectedMessage {
+			t.Errorf("wrong error message. Expected %q, got %q",
+				tt.expectedMessage, errObj.Message)
+		}
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	env := object.NewEnvironment()
+	env.Set("moo", &object.Integer{Value: 5})
+	inner := object.NewEnclosedEnvironment(env)
+
+	ident := &ast.Identifier{
+		Token: token.Token{Type: token.IDENT, Literal: "moo"},
+		Value: "moo",
+	}
+	testIntegerObject(t, Eval(ident, inner), 5)
+}
+
+func TestFunctionObject(t *testing.T) {
+	evaluated := testEval(t, "fn(x) { x + 2; };")
+
+	fn, ok := evaluated.(*object.Function)
+	if !ok {
+		t.Fatalf("object is not Function. Got %T (%+v)", evaluated, evaluated)
+	}
+	if len(fn.Parameters) != 1 || fn.Parameters[0].String() != "x" {
+		t.Fatalf("function has wrong parameters: %+v", fn.Parameters)
+	}
+	if fn.Body.String() != "{ (x+2); }" {
+		t.Fatalf("body is not %q. Got %q", "{ (x+2); }", fn.Body.String())
+	}
+}
+
+func TestFunctionApplication(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let identity = fn(x) { x; }; identity(5);", 5},
+		{"let identity = fn(x) { return x; }; identity(5);", 5},
+		{"let double = fn(x) { x * 2; }; double(5);", 10},
+		{"let add = fn(x, y) { x + y; }; add(5, 2.5);", 7.5},
+		{"let add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));", 20},
+		{"fn(x) { x; }(5)", 5},
+		{"let f = fn() { return 1; 2 }; f() + 1", 2},
+		{"let newAdder = fn(x) { fn(y) { x + y } }; let addTwo = newAdder(2); addTwo(3)", 5},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+}
+
+func TestFunctionErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"5(1)", "Not a function: INTEGER"},
+		{"fn(x) { x }(1, 2)", "Wrong number of arguments: expected 1, got 2"},
+		{"fn(x) { x }(moo)", "Identifier not found: moo"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. Got %T (%+v)",
+				evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expectedMessage {
+			t.Errorf("wrong error message. Expected %q, got %q",
+				tt.expectedMessage, errObj.Message)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"moo cow"`, "moo cow"},
+		{`"moo" + " " + "cow"`, "moo cow"},
+		{`let greet = fn(name) { "hello " + name }; greet("🐮")`, "hello 🐮"},
+		{`"moo" == "moo"`, true},
+		{`"moo" != "moo"`, false},
+		{`"moo" == "cow"`, false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. Got %T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("String has wrong value. Expected %q, got %q", expected, str.Value)
+			}
+		default:
+			testObject(t, evaluated, expected)
+		}
+	}
+
+	evaluated := testEval(t, `"moo" - "cow"`)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok || errObj.Message != "Unknown operator: STRING - STRING" {
+		t.Errorf("expected unknown operator error, got %T (%+v)", evaluated, evaluated)
+	}
+}
+
+func TestNewOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7.5 % 2", 1.5},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"2 ** 0", 1},
+		{"2 ** -1", 0.5},
+		{"2.0 ** 3", 8.0},
+		{"4 ** 0.5", 2.0},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"2.5 >= 2", true},
+		{"1 >= 2", false},
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3", true},
+		{"false && moo", false},
+		{"true || moo", true},
+		{"5 && 0", true},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+
+	evaluated := testEval(t, "1 % 0")
+	errObj, ok := evaluated.(*object.Error)
+	if !ok || errObj.Message != "Division by zero: 1 % 0" {
+		t.Errorf("expected division by zero error, got %T (%+v)", evaluated, evaluated)
+	}
+}
+
+func TestArrays(t *testing.T) {
+	evaluated := testEval(t, "[1, 2.5 * 2, true]")
+
+	result, ok := evaluated.(*object.Array)
+	if !ok {
+		t.Fatalf("object is not Array. Got %T (%+v)", evaluated, evaluated)
+	}
+	if len(result.Elements) != 3 {
+		t.Fatalf("array has wrong number of elements. Got %d", len(result.Elements))
+	}
+	testIntegerObject(t, result.Elements[0], 1)
+	testFloatObject(t, result.Elements[1], 5.0)
+	testBooleanObject(t, result.Elements[2], true)
+	if result.Inspect() != "[1, 5.0, true]" {
+		t.Errorf("Inspect wrong. Expected %q, got %q", "[1, 5.0, true]", result.Inspect())
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"[1, 2, 3][0]", 1},
+		{"[1, 2, 3][2]", 3},
+		{"let i = 0; [1][i]", 1},
+		{"[1, 2, 3][1 + 1]", 3},
+		{"let xs = [1, 2.5, true]; xs[1]", 2.5},
+		{"let xs = [1, 2, 3]; xs[0] + xs[1] + xs[2]", 6},
+		{"[[1, 2], [3]][1][0]", 3},
+		{"[fn(x) { x * 2 }][0](4)", 8},
+		{"[1, 2, 3][3]", nil},
+		{"[1, 2, 3][-1]", nil},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+
+	evaluated = testEval(t, "5[0]")
+	errObj, ok := evaluated.(*object.Error)
+	if !ok || errObj.Message != "Index operator not supported: INTEGER[INTEGER]" {
+		t.Errorf("expected index error, got %T (%+v)", evaluated, evaluated)
+	}
+}
+
+func TestHashes(t *testing.T) {
+	input := `let two = "two";
+{"one": 10 - 9, two: 1 + 1, "thr" + "ee": 6 / 2, 4: 4, true: 5, false: 6, 1.5: 7}`
+
+	evaluated := testEval(t, input)
+	result, ok := evaluated.(*object.Hash)
+	if !ok {
+		t.Fatalf("object is not Hash. Got %T (%+v)", evaluated, evaluated)
+	}
+
+	expected := `{one: 1, two: 2, three: 3, 4: 4, true: 5, false: 6, 1.5: 7}`
+	if result.Inspect() != expected {
+		t.Errorf("Inspect wrong. Expected %q, got %q", expected, result.Inspect())
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`{"foo": 5}["foo"]`, 5},
+		{`{"foo": 5}["bar"]`, nil},
+		{`let key = "foo"; {"foo": 5}[key]`, 5},
+		{`{}["foo"]`, nil},
+		{`{5: 5}[5]`, 5},
+		{`{5: 5}[5.0]`, 5},
+		{`{true: 5}[true]`, 5},
+		{`{false: 5}[false]`, 5},
+		{`{2.5: 1}[2.5]`, 1},
+		{`{"a": 1, "a": 2}["a"]`, 2},
+		{`{"a": {"b": [1, 2]}}["a"]["b"][1]`, 2},
+		{`{ let x = 1; x + 1 }`, 2},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+
+	errors := []struct {
+		input    string
+		expected string
+	}{
+		{`{"name": "MonCow"}[fn(x) { x }]`, "Unusable as hash key: FUNCTION"},
+		{`{[1]: 2}`, "Unusable as hash key: ARRAY"},
+		{`{"a": b}`, "Identifier not found: b"},
+	}
+
+	for _, tt := range errors {
+		evaluated := testEval(t, tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. Got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. Expected %q, got %q", tt.expected, errObj.Message)
+		}
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"while (false) { 1 }", nil},
+		{"let i = 0; while (i < 5) { let i = i + 1; }; i", 5},
+		{"let i = 0; while (true) { let i = i + 1; if (i == 3) { break } }; i", 3},
+		{"let i = 0; let n = 0; while (i < 5) { let i = i + 1; if (i % 2 == 0) { continue } let n = n + i; }; n", 9},
+		{"let i = 0; while (true) { let i = i + 1; if (i > 2) { if (true) { break; } } }; i", 3},
+		{"let f = fn() { while (true) { return 7; } }; f()", 7},
+		{"let f = fn() { for (;;) { while (true) { break } return 8 } }; f()", 8},
+		{"for (let i = 10; i > 5;) { let i = i - 2; }; i", 4},
+		{"let n = 0; for (let i = 0; ; ) { let n = n + 1; if (n == 4) { break } }; n", 4},
+		{"let n = 0; for (let i = 0; i < 3; n) { let i = i + 1; let n = n + 2; }; n", 6},
+		{"let xs = [10, 20, 30]; let s = 0; let i = 0; while (i < 3) { let s = s + xs[i]; let i = i + 1; }; s", 60},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+
+	errors := []struct {
+		input    string
+		expected string
+	}{
+		{"while (x) { 1 }", "Identifier not found: x"},
+		{"while (true) { 1 + true }", "Type mismatch: INTEGER + BOOLEAN"},
+		{"for (let i = y; ; ) { }", "Identifier not found: y"},
+		{"for (; ; z) { }", "Identifier not found: z"},
+	}
+
+	for _, tt := range errors {
+		evaluated := testEval(t, tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. Got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. Expected %q, got %q", tt.expected, errObj.Message)
+		}
+	}
+}
+
+func TestAssignment(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = 2", 2},
+		{"let x = 1; (x) = 3; x", 3},
+		{"let x = 1; let y = 1; x = y = 5; x + y", 10},
+		{"let x = 10; x += 5; x", 15},
+		{"let x = 10; x -= 5; x", 5},
+		{"let x = 10; x *= 5; x", 50},
+		{"let x = 10; x /= 4; x", 2},
+		{"let x = 10; x /= 4.0; x", 2.5},
+		{"let x = 1; let f = fn() { x = 7 }; f(); x", 7},
+		{"let x = 1; let f = fn(x) { x = 7 }; f(2); x", 1},
+		{"let n = 0; for (let i = 0; i < 5; i += 1) { n += i }; n", 10},
+		{"let i = 0; while (true) { i += 1; if (i == 4) { break } }; i", 4},
+		{"let xs = [1, 2, 3]; xs[1] = 20; xs[1]", 20},
+		{"let xs = [1, 2, 3]; xs[2] *= 3; xs[2]", 9},
+		{`let h = {"a": 1}; h["b"] = 2; h["b"]`, 2},
+		{`let h = {"a": 1}; h["a"] += 9; h["a"]`, 10},
+		{`let h = {"a": [1]}; h["a"][0] = 5; h["a"][0]`, 5},
+	}
+
+	for _, tt := range tests {
+		testObject(t, testEval(t, tt.input), tt.expected)
+	}
+
+	errors := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 1", "Identifier not found: x"},
+		{"x += 1", "Identifier not found: x"},
+		{"let x = true; x += 1", "Type mismatch: BOOLEAN + INTEGER"},
+		{"let x = 1; x /= 0", "Division by zero: 1 / 0"},
+		{"let xs = [1]; xs[1] = 2", "Index out of range: 1"},
+		{"let xs = [1]; xs[true] = 2", "Index assignment not supported: ARRAY[BOOLEAN]"},
+		{"let h = {}; h[[1]] = 2", "Unusable as hash key: ARRAY"},
+		{"let s = 1; s[0] = 2", "Index assignment not supported: INTEGER[INTEGER]"},
+	}
+
+	for _, tt := range errors {
+		evaluated := testEval(t, tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. Got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. Expected %q, got %q", tt.expected, errObj.Message)
+		}
+	}
+}
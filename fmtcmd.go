@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/cowlet/moncow/diff"
+	"github.com/cowlet/moncow/format"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/* Files with this extension are formatted when a directory is given */
+const sourceExt = ".mc"
+
+type fmtOptions struct {
+	write bool // rewrite files in place
+	list  bool // list the files that aren't formatted
+	diff  bool // show a diff for each file that isn't formatted
+}
+
+/*
+runFmt is `moncow fmt`, which works like gofmt: with no paths it formats
+standard input to standard output. It returns the exit status.
+*/
+func runFmt(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var opts fmtOptions
+	flags.BoolVar(&opts.write, "w", false, "write result to the source file instead of stdout")
+	flags.BoolVar(&opts.list, "l", false, "list files whose formatting differs")
+	flags.BoolVar(&opts.diff, "d", false, "display diffs instead of rewriting files")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		if opts.write {
+			fmt.Fprintln(stderr, "Cannot use -w with standard input")
+			return 2
+		}
+		src, err := io.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		if !formatSource("<standard input>", string(src), opts, stdout, stderr) {
+			return 2
+		}
+		return 0
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			/* Files named explicitly are formatted whatever their extension */
+			if info.IsDir() || (file != path && filepath.Ext(file) != sourceExt) {
+				return nil
+			}
+			if !formatFile(file, opts, stdout, stderr) {
+				status = 2
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 2
+		}
+	}
+	return status
+}
+
+func formatFile(file string, opts fmtOptions, stdout, stderr io.Writer) bool {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return false
+	}
+	return formatSource(file, string(src), opts, stdout, stderr)
+}
+
+/* formatSource reports whether src could be formatted */
+func formatSource(name, src string, opts fmtOptions, stdout, stderr io.Writer) bool {
+	formatted, diagnostics := format.Source(name, src)
+	if len(diagnostics) != 0 {
+		for _, d := range diagnostics {
+			fmt.Fprint(stderr, d.Render(src))
+		}
+		return false
+	}
+
+	changed := formatted != src
+	if opts.list && changed {
+		fmt.Fprintln(stdout, name)
+	}
+	if opts.write && changed {
+		info, err := os.Stat(name)
+		if err == nil {
+			err = os.WriteFile(name, []byte(formatted), info.Mode().Perm())
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return false
+		}
+	}
+	if opts.diff && changed {
+		fmt.Fprint(stdout, diff.Unified(name, src, formatted))
+	}
+	if !opts.list && !opts.write && !opts.diff {
+		fmt.Fprint(stdout, formatted)
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFmtStdin(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	status := runFmt(nil, strings.NewReader("let  x =  1\n"), &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("Expected status 0, got %d: %s", status, stderr.String())
+	}
+	if stdout.String() != "let x = 1;\n" {
+		t.Errorf("Expected formatted output, got %q", stdout.String())
+	}
+}
+
+func TestFmtParseError(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	status := runFmt(nil, strings.NewReader("let = 1;\n"), &stdout, &stderr)
+	if status != 2 {
+		t.Errorf("Expected status 2, got %d", status)
+	}
+	if stderr.Len() == 0 {
+		t.Errorf("Expected the parse error on stderr")
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no output, got %q", stdout.String())
+	}
+}
+
+func TestFmtFiles(t *testing.T) {
+	dir := t.TempDir()
+	messy := filepath.Join(dir, "messy.mc")
+	tidy := filepath.Join(dir, "tidy.mc")
+	other := filepath.Join(dir, "notes.txt")
+	writeFile(t, messy, "let  x = 1\nx\n")
+	writeFile(t, tidy, "let y = 2;\n")
+	writeFile(t, other, "not  moncow\n")
+
+	var stdout, stderr bytes.Buffer
+	if status := runFmt([]string{"-l", dir}, nil, &stdout, &stderr); status != 0 {
+		t.Fatalf("-l: expected status 0, got %d: %s", status, stderr.String())
+	}
+	if stdout.String() != messy+"\n" {
+		t.Errorf("-l: expected only %s listed, got %q", messy, stdout.String())
+	}
+
+	stdout.Reset()
+	if status := runFmt([]string{"-d", messy}, nil, &stdout, &stderr); status != 0 {
+		t.Fatalf("-d: expected status 0, got %d: %s", status, stderr.String())
+	}
+	expectedDiff := "--- " + messy + ".orig\n+++ " + messy + "\n" +
+		"@@ -1,2 +1,2 @@\n-let  x = 1\n-x\n+let x = 1;\n+x;\n"
+	if stdout.String() != expectedDiff {
+		t.Errorf("-d: expected\n%s\ngot\n%s", expectedDiff, stdout.String())
+	}
+
+	stdout.Reset()
+	if status := runFmt([]string{"-w", dir}, nil, &stdout, &stderr); status != 0 {
+		t.Fatalf("-w: expected status 0, got %d: %s", status, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("-w: expected no output, got %q", stdout.String())
+	}
+	if got := readFile(t, messy); got != "let x = 1;\nx;\n" {
+		t.Errorf("-w: expected %s rewritten, got %q", messy, got)
+	}
+	if got := readFile(t, other); got != "not  moncow\n" {
+		t.Errorf("-w: expected %s untouched, got %q", other, got)
+	}
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
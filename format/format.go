@@ -0,0 +1,583 @@
+package format
+
+import (
+	"bytes"
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/cst"
+	"github.com/cowlet/moncow/diagnostic"
+	"github.com/cowlet/moncow/parser"
+	"github.com/cowlet/moncow/token"
+	"sort"
+	"strings"
+)
+
+/*
+Source formats MonCow source canonically, keeping its comments. Source that
+doesn't parse is left alone, and its diagnostics returned instead.
+*/
+func Source(filename, source string) (string, []diagnostic.Diagnostic) {
+	tree, program, diagnostics := cst.Parse(filename, source)
+	if len(diagnostics) != 0 {
+		return source, diagnostics
+	}
+
+	p := &printer{closers: map[int]*cst.Token{}}
+	opened := []*cst.Token{}
+	for _, tok := range tree.Tokens() {
+		for _, trivia := range tok.Leading {
+			p.addComment(trivia, false)
+		}
+		for _, trivia := range tok.Trailing {
+			p.addComment(trivia, true)
+		}
+
+		switch tok.Type {
+		case token.EOF:
+			continue
+		case token.LBRACE:
+			opened = append(opened, tok)
+		case token.RBRACE:
+			if len(opened) > 0 {
+				p.closers[opened[len(opened)-1].Pos.Offset] = tok
+				opened = opened[:len(opened)-1]
+			}
+		}
+		p.tokens = append(p.tokens, tok)
+	}
+
+	p.program(program, len(source)+1)
+	return p.out.String(), nil
+}
+
+/* Program formats an AST, which has no comments or blank lines to keep */
+func Program(program *ast.Program) string {
+	p := &printer{closers: map[int]*cst.Token{}}
+	p.program(program, 0)
+	return p.out.String()
+}
+
+type comment struct {
+	token.Trivia
+	trailing bool // on the same line as the token before it
+	endLine  int
+}
+
+type printer struct {
+	out    bytes.Buffer
+	indent int
+
+	/* What's known of the source, for comments and layout */
+	comments []comment          // in source order, and not yet printed
+	tokens   []*cst.Token       // in source order, without trivia or EOF
+	closers  map[int]*cst.Token // the '}' for the '{' at each offset
+
+	lastLine int // the source line the last printed item ended on
+
+	/* What's owed after a comment inside a statement, before the next text */
+	space  bool // a block comment ended, so a space
+	broken bool // a line comment ended, so a new line
+}
+
+func (p *printer) addComment(trivia token.Trivia, trailing bool) {
+	if trivia.Kind == token.WHITESPACE {
+		return
+	}
+	p.comments = append(p.comments, comment{
+		Trivia:   trivia,
+		trailing: trailing,
+		endLine:  trivia.Pos.Line + strings.Count(trivia.Text, "\n"),
+	})
+}
+
+func (p *printer) program(program *ast.Program, end int) {
+	p.statements(program.Statements, end, false)
+	if p.out.Len() > 0 {
+		p.out.WriteString("\n")
+	}
+}
+
+/*
+statements prints a statement list one item per line, with the comments that
+come before end. A blank line between items in the source is kept, but runs of
+blank lines become just the one.
+*/
+func (p *printer) statements(stmts []ast.Statement, end int, inBlock bool) {
+	first := true
+	item := func(line int) {
+		if inBlock || !first {
+			p.out.WriteString("\n")
+		}
+		if !first && p.lastLine > 0 && line > p.lastLine+1 {
+			p.out.WriteString("\n")
+		}
+		p.out.WriteString(strings.Repeat("\t", p.indent))
+		first = false
+	}
+	flush := func(before int) {
+		for len(p.comments) > 0 && p.comments[0].Pos.Offset < before {
+			c := p.comments[0]
+			p.comments = p.comments[1:]
+			if c.trailing && !first && c.Pos.Line == p.lastLine {
+				p.out.WriteString(" ")
+			} else {
+				item(c.Pos.Line)
+			}
+			p.out.WriteString(c.Text)
+			p.lastLine = c.endLine
+		}
+	}
+
+	for i, stmt := range stmts {
+		start := startOf(stmt)
+		flush(start.Pos.Offset)
+		item(start.Pos.Line)
+
+		var next ast.Statement
+		stmtEnd := end
+		if i+1 < len(stmts) {
+			next = stmts[i+1]
+			stmtEnd = startOf(next).Pos.Offset
+		}
+		p.statement(stmt, next)
+		p.lastLine = p.lineBefore(stmtEnd)
+	}
+	flush(end)
+}
+
+/* startOf gives the first token of a statement */
+func startOf(stmt ast.Statement) token.Token {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		return stmt.Token
+	case *ast.ReturnStatement:
+		return stmt.Token
+	case *ast.ExpressionStatement:
+		return stmt.Token
+	case *ast.BlockStatement:
+		return stmt.Token
+	case *ast.WhileStatement:
+		return stmt.Token
+	case *ast.ForStatement:
+		return stmt.Token
+	case *ast.BreakStatement:
+		return stmt.Token
+	case *ast.ContinueStatement:
+		return stmt.Token
+	}
+	return token.Token{}
+}
+
+/* lineBefore is the line of the last source token before offset */
+func (p *printer) lineBefore(offset int) int {
+	i := sort.Search(len(p.tokens), func(i int) bool {
+		return p.tokens[i].Pos.Offset >= offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return p.tokens[i-1].Pos.Line
+}
+
+func (p *printer) statement(stmt ast.Statement, next ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		p.let(stmt)
+		p.semi(stmt)
+	case *ast.ReturnStatement:
+		p.emit(stmt.Token.Pos.Offset, "return")
+		if stmt.Value != nil {
+			p.out.WriteString(" ")
+			p.expression(stmt.Value)
+		}
+		p.semi(stmt)
+	case *ast.ExpressionStatement:
+		p.expression(stmt.Expression)
+		if needsSemi(stmt, next) {
+			p.semi(stmt)
+		}
+	case *ast.BlockStatement:
+		p.block(stmt)
+	case *ast.WhileStatement:
+		p.emit(stmt.Token.Pos.Offset, "while (")
+		p.expression(stmt.Condition)
+		p.emit(p.after(stmt.Condition.End(), token.RPAREN), ") ")
+		p.block(stmt.Body)
+	case *ast.ForStatement:
+		p.emit(stmt.Token.Pos.Offset, "for (")
+		semi := stmt.Token.End.Offset
+		switch init := stmt.Init.(type) {
+		case *ast.LetStatement:
+			p.let(init)
+			semi = init.End()
+		case *ast.ExpressionStatement:
+			p.expression(init.Expression)
+			semi = init.End()
+		}
+		semi = p.after(semi, token.SEMI)
+		p.emit(semi, ";")
+		if stmt.Condition != nil {
+			p.out.WriteString(" ")
+			p.expression(stmt.Condition)
+			semi = stmt.Condition.End()
+		}
+		semi = p.after(semi+1, token.SEMI)
+		p.emit(semi, ";")
+		closer := semi + 1
+		if stmt.Post != nil {
+			p.out.WriteString(" ")
+			p.expression(stmt.Post)
+			closer = stmt.Post.End()
+		}
+		p.emit(p.after(closer, token.RPAREN), ") ")
+		p.block(stmt.Body)
+	case *ast.BreakStatement:
+		p.emit(stmt.Token.Pos.Offset, "break")
+		p.semi(stmt)
+	case *ast.ContinueStatement:
+		p.emit(stmt.Token.Pos.Offset, "continue")
+		p.semi(stmt)
+	}
+}
+
+func (p *printer) let(ls *ast.LetStatement) {
+	p.emit(ls.Token.Pos.Offset, "let ")
+	p.emit(ls.Name.Token.Pos.Offset, ls.Name.Value)
+	p.emit(p.after(ls.Name.End(), token.ASSIGN), " = ")
+	p.expression(ls.Value)
+}
+
+/* semi ends a statement with a ';', where the source's was if it had one */
+func (p *printer) semi(stmt ast.Statement) {
+	p.emit(p.after(stmt.End(), token.SEMI), ";")
+}
+
+/*
+needsSemi says whether an expression statement needs a ';'. One ending in a
+block only does if the next statement would otherwise carry on from it, as in
+`if (x) { a }; -1`.
+*/
+func needsSemi(stmt *ast.ExpressionStatement, next ast.Statement) bool {
+	if _, ok := ast.Unparen(stmt.Expression).(*ast.IfExpression); !ok {
+		return true
+	}
+	if next, ok := next.(*ast.ExpressionStatement); ok {
+		return parser.Precedence(next.Token.Type) > parser.LOWEST
+	}
+	return false
+}
+
+/*
+block prints a block over several lines, unless it was written on one line and
+holds at most one statement that also fits on it.
+*/
+func (p *printer) block(blk *ast.BlockStatement) {
+	p.emit(blk.Token.Pos.Offset, "")
+	end, closer := 0, p.closers[blk.Token.Pos.Offset]
+	if closer != nil {
+		end = closer.Pos.Offset
+	}
+	hasComments := len(p.comments) > 0 && p.comments[0].Pos.Offset < end
+
+	if closer != nil && closer.Pos.Line == blk.Token.Pos.Line && !hasComments &&
+		len(blk.Statements) <= 1 {
+		if len(blk.Statements) == 0 {
+			p.out.WriteString("{}")
+			return
+		}
+
+		mark, lastLine := p.out.Len(), p.lastLine
+		p.out.WriteString("{ ")
+		p.inlineStatement(blk.Statements[0])
+		p.out.WriteString(" }")
+		if !bytes.ContainsRune(p.out.Bytes()[mark:], '\n') {
+			return
+		}
+		p.out.Truncate(mark) // it didn't fit after all
+		p.lastLine = lastLine
+	}
+
+	if len(blk.Statements) == 0 && !hasComments {
+		p.out.WriteString("{}")
+		return
+	}
+	p.out.WriteString("{")
+	p.indent++
+	p.statements(blk.Statements, end, true)
+	p.indent--
+	p.out.WriteString("\n" + strings.Repeat("\t", p.indent) + "}")
+}
+
+/* The '}' follows, so an inline expression statement needs no ';' */
+func (p *printer) inlineStatement(stmt ast.Statement) {
+	if es, ok := stmt.(*ast.ExpressionStatement); ok {
+		p.expression(es.Expression)
+		return
+	}
+	p.statement(stmt, nil)
+}
+
+/* An expression that nothing can split, on either side */
+const atomic = parser.INDEX + 1
+
+/*
+leftPrecedence is how tightly an expression holds together with an operator
+after it, and rightPrecedence with one before it. A call is closed on the
+right by its ')', for example, but a prefix expression is open to whatever
+binds tighter than PREFIX.
+*/
+func leftPrecedence(exp ast.Expression) int {
+	switch exp := ast.Unparen(exp).(type) {
+	case *ast.InfixExpression:
+		return parser.Precedence(exp.Token.Type)
+	case *ast.AssignExpression:
+		return parser.ASSIGN
+	case *ast.PrefixExpression:
+		return parser.PREFIX
+	}
+	return atomic
+}
+
+func rightPrecedence(exp ast.Expression) int {
+	switch exp := ast.Unparen(exp).(type) {
+	case *ast.InfixExpression:
+		return parser.Precedence(exp.Token.Type)
+	case *ast.AssignExpression:
+		return parser.ASSIGN
+	case *ast.CallExpression:
+		return parser.CALL
+	case *ast.IndexExpression:
+		return parser.INDEX
+	}
+	return atomic
+}
+
+/* operand prints exp in parentheses if it wouldn't otherwise parse back as one */
+func (p *printer) operand(exp ast.Expression, parenthesize bool) {
+	if parenthesize {
+		p.emit(exp.Pos(), "(")
+	}
+	p.expression(exp)
+	if parenthesize {
+		p.out.WriteString(")")
+	}
+}
+
+/* left and right print the operands of an operator with the given precedence */
+func (p *printer) left(exp ast.Expression, precedence int, rightAssoc bool) {
+	lp := leftPrecedence(exp)
+	p.operand(exp, lp < precedence || (lp == precedence && rightAssoc))
+}
+
+func (p *printer) right(exp ast.Expression, precedence int, rightAssoc bool) {
+	rp := rightPrecedence(exp)
+	p.operand(exp, rp < precedence || (rp == precedence && !rightAssoc))
+}
+
+func (p *printer) expression(exp ast.Expression) {
+	switch exp := exp.(type) {
+	case *ast.Identifier:
+		p.emit(exp.Token.Pos.Offset, exp.Value)
+	case *ast.IntegerLiteral:
+		p.emit(exp.Token.Pos.Offset, exp.Token.Literal)
+	case *ast.FloatLiteral:
+		p.emit(exp.Token.Pos.Offset, exp.Token.Literal)
+	case *ast.StringLiteral:
+		p.emit(exp.Token.Pos.Offset, exp.String())
+	case *ast.Boolean:
+		p.emit(exp.Token.Pos.Offset, exp.String())
+	case *ast.PrefixExpression:
+		p.emit(exp.Token.Pos.Offset, exp.Operator)
+		p.right(exp.Right, parser.PREFIX, false)
+	case *ast.InfixExpression:
+		prec := parser.Precedence(exp.Token.Type)
+		rightAssoc := parser.RightAssociative(exp.Token.Type)
+		p.left(exp.Left, prec, rightAssoc)
+		p.emit(exp.Token.Pos.Offset, " "+exp.Operator+" ")
+		p.right(exp.Right, prec, rightAssoc)
+	case *ast.AssignExpression:
+		p.left(exp.Target, parser.ASSIGN, true)
+		p.emit(exp.Token.Pos.Offset, " "+exp.Operator+" ")
+		p.right(exp.Value, parser.ASSIGN, true)
+	case *ast.ParenExpression:
+		/* The operators around it put back whatever parentheses are needed */
+		p.expression(exp.Expression)
+	case *ast.IfExpression:
+		p.ifExpression(exp)
+	case *ast.FunctionLiteral:
+		p.emit(exp.Token.Pos.Offset, "fn")
+		open := p.after(exp.Token.End.Offset, token.LPAREN)
+		closer := open + 1
+		items := make([]listItem, len(exp.Parameters))
+		for i, param := range exp.Parameters {
+			param := param
+			items[i] = listItem{param.Pos(), param.End(), func() { p.expression(param) }}
+			closer = param.End()
+		}
+		p.list(open, "(", items, p.after(closer, token.RPAREN), ")")
+		p.out.WriteString(" ")
+		p.block(exp.Body)
+	case *ast.CallExpression:
+		p.left(exp.Function, parser.CALL, false)
+		p.list(exp.Token.Pos.Offset, "(", expressionItems(p, exp.Arguments), exp.Rparen.Pos.Offset, ")")
+	case *ast.ArrayLiteral:
+		p.list(exp.Token.Pos.Offset, "[", expressionItems(p, exp.Elements), exp.Rbracket.Pos.Offset, "]")
+	case *ast.IndexExpression:
+		p.left(exp.Left, parser.INDEX, false)
+		p.emit(exp.Token.Pos.Offset, "[")
+		p.expression(exp.Index)
+		p.emit(exp.Rbracket.Pos.Offset, "]")
+	case *ast.HashLiteral:
+		items := make([]listItem, len(exp.Pairs))
+		for i, pair := range exp.Pairs {
+			pair := pair
+			items[i] = listItem{pair.Key.Pos(), pair.Value.End(), func() {
+				p.expression(pair.Key)
+				p.emit(p.after(pair.Key.End(), token.COLON), ": ")
+				p.expression(pair.Value)
+			}}
+		}
+		p.list(exp.Token.Pos.Offset, "{", items, exp.Rbrace.Pos.Offset, "}")
+	}
+}
+
+/* A listItem is something printed between the commas of a list */
+type listItem struct {
+	pos, end int // its span in the source
+	print    func()
+}
+
+func expressionItems(p *printer, exps []ast.Expression) []listItem {
+	items := make([]listItem, len(exps))
+	for i, exp := range exps {
+		exp := exp
+		items[i] = listItem{exp.Pos(), exp.End(), func() { p.expression(exp) }}
+	}
+	return items
+}
+
+/*
+list prints items between open and close, the offsets of its brackets. A list
+with a comment inside that must end its line goes over several lines, with an
+item on each, so that every comment stays by the item it was written next to.
+*/
+func (p *printer) list(open int, openText string, items []listItem, close int, closeText string) {
+	p.emit(open, openText)
+	multiline := p.lineCommentBefore(open, close)
+	if multiline {
+		p.indent++
+	}
+	for i, item := range items {
+		if i > 0 {
+			p.emit(p.after(items[i-1].end, token.COMMA), ",")
+			if !multiline {
+				p.out.WriteString(" ")
+			}
+		}
+		if multiline {
+			p.inlineComments(item.pos, p.indent)
+			p.newline(p.indent)
+		}
+		item.print()
+	}
+	if multiline {
+		if len(items) > 0 {
+			p.emit(p.after(items[len(items)-1].end, token.COMMA), ",")
+		}
+		p.inlineComments(close, p.indent)
+		p.indent--
+		p.newline(p.indent)
+	}
+	p.emit(close, closeText)
+}
+
+func (p *printer) ifExpression(ie *ast.IfExpression) {
+	p.emit(ie.Token.Pos.Offset, "if (")
+	p.expression(ie.Condition)
+	p.emit(p.after(ie.Condition.End(), token.RPAREN), ") ")
+	p.block(ie.IfBlock)
+
+	elseAt := p.after(ie.IfBlock.End(), token.ELSE)
+	switch alt := ie.ElseBlock.(type) {
+	case *ast.IfExpression:
+		p.emit(elseAt, " else ")
+		p.ifExpression(alt)
+	case *ast.BlockStatement:
+		p.emit(elseAt, " else ")
+		p.block(alt)
+	}
+}
+
+/* after gives the offset of the next source token from offset, if it's a typ */
+func (p *printer) after(offset int, typ token.TokenType) int {
+	i := sort.Search(len(p.tokens), func(i int) bool {
+		return p.tokens[i].Pos.Offset >= offset
+	})
+	if i < len(p.tokens) && p.tokens[i].Type == typ {
+		return p.tokens[i].Pos.Offset
+	}
+	return offset
+}
+
+/*
+emit prints text for the source token at offset, after the comments that come
+before it. Those are kept where they were written, within the statement, and a
+line comment breaks the line, carrying on one indent further in.
+*/
+func (p *printer) emit(offset int, text string) {
+	p.inlineComments(offset, p.indent+1)
+	switch {
+	case p.broken:
+		p.newline(p.indent + 1)
+		text = strings.TrimLeft(text, " ")
+	case p.space && text != "" && !strings.ContainsAny(text[:1], " ,;:)]}"):
+		p.out.WriteString(" ")
+	case p.space && text == "":
+		p.out.WriteString(" ")
+	}
+	p.space = false
+	p.out.WriteString(text)
+}
+
+/*
+inlineComments prints the comments before offset, inside a statement. One
+written on a line of its own goes on a new line at indent, and others go after
+what's printed, with a space between unless a block comment opens a bracket.
+*/
+func (p *printer) inlineComments(before int, indent int) {
+	for len(p.comments) > 0 && p.comments[0].Pos.Offset < before {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		if c.trailing && !p.broken {
+			gap := " \t\n"
+			if c.Kind == token.BLOCK_COMMENT {
+				gap += "([{"
+			}
+			if out := p.out.Bytes(); len(out) > 0 && !strings.ContainsRune(gap, rune(out[len(out)-1])) {
+				p.out.WriteString(" ")
+			}
+		} else {
+			p.newline(indent)
+		}
+		p.out.WriteString(c.Text)
+		p.broken = c.Kind == token.LINE_COMMENT || strings.Contains(c.Text, "\n")
+		p.space = !p.broken
+	}
+}
+
+/* lineCommentBefore says whether a comment that ends its line is between from and to */
+func (p *printer) lineCommentBefore(from, to int) bool {
+	for _, c := range p.comments {
+		if c.Pos.Offset >= to {
+			break
+		}
+		if c.Pos.Offset > from && (c.Kind == token.LINE_COMMENT || strings.Contains(c.Text, "\n")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) newline(indent int) {
+	p.out.WriteString("\n" + strings.Repeat("\t", indent))
+	p.space, p.broken = false, false
+}
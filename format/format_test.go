@@ -0,0 +1,238 @@
+package format
+
+import (
+	goast "go/ast"
+	goparser "go/parser"
+	gotoken "go/token"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/cowlet/moncow/lexer"
+	"github.com/cowlet/moncow/parser"
+	"github.com/cowlet/moncow/token"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"let x =5", "let x = 5;\n"},
+		{"let   x = 5 ;let y =x *2;", "let x = 5;\nlet y = x * 2;\n"},
+		{"1+2*3", "1 + 2 * 3;\n"},
+		{"(1+2)*3", "(1 + 2) * 3;\n"},
+		{"((a))", "a;\n"},
+		{"a-(b-c)", "a - (b - c);\n"},
+		{"(a-b)-c", "a - b - c;\n"},
+		{"a**(b**c)", "a ** b ** c;\n"},
+		{"(a**b)**c", "(a ** b) ** c;\n"},
+		{"-(a**b)", "-a ** b;\n"},
+		{"(-a)**b", "(-a) ** b;\n"},
+		{"-(-a)", "--a;\n"},
+		{"!(a == b)", "!(a == b);\n"},
+		{"(a + b)(c)", "(a + b)(c);\n"},
+		{"(-xs)[0]", "(-xs)[0];\n"},
+		{"(f(1))[0]", "f(1)[0];\n"},
+		{"x = (y = z)", "x = y = z;\n"},
+		{"(x = y) + z", "(x = y) + z;\n"},
+		{"a + (x = 1)", "a + (x = 1);\n"},
+		{"a || b && c", "a || b && c;\n"},
+		{"(a || b) && c", "(a || b) && c;\n"},
+		{`let s = "a\tb"`, "let s = \"a\\tb\";\n"},
+		{"let xs = [1,2.50,true,]", "let xs = [1, 2.50, true];\n"},
+		{`let h = {"a":1,2:[],}`, "let h = {\"a\": 1, 2: []};\n"},
+		{"{}", "{};\n"},
+		{"add(1,2,)", "add(1, 2);\n"},
+		{"return ;", "return;\n"},
+		{"let f = fn(x,y){x + y}", "let f = fn(x, y) { x + y };\n"},
+		{"let f = fn(x,y){\nreturn x + y}", "let f = fn(x, y) {\n\treturn x + y;\n};\n"},
+		{"let f = fn(){ }", "let f = fn() {};\n"},
+		{"map(xs, fn(x) { x * 2 })", "map(xs, fn(x) { x * 2 });\n"},
+		{"if(a){b}else if(c){d}else{e}", "if (a) { b } else if (c) { d } else { e }\n"},
+		{"if (a) {\nb; c\n}", "if (a) {\n\tb;\n\tc;\n}\n"},
+		{"if (a) { b }; -1", "if (a) { b };\n-1;\n"},
+		{"if (a) { b }; x", "if (a) { b }\nx;\n"},
+		{"while(x){x -= 1}", "while (x) { x -= 1 }\n"},
+		{"for(let i = 0;i < 3;i += 1){\nbreak\n}", "for (let i = 0; i < 3; i += 1) {\n\tbreak;\n}\n"},
+		{"for(;;){continue}", "for (;;) { continue; }\n"},
+		{"{ x; y }", "{\n\tx;\n\ty;\n}\n"},
+		{"{\nlet x = 1\n}", "{\n\tlet x = 1;\n}\n"},
+		{"let f = fn() {\nif (a) {\nreturn 1\n}\n2\n}",
+			"let f = fn() {\n\tif (a) {\n\t\treturn 1;\n\t}\n\t2;\n};\n"},
+	}
+
+	for _, tt := range tests {
+		actual, diagnostics := Source("test.mc", tt.input)
+		if len(diagnostics) != 0 {
+			t.Errorf("unexpected diagnostics for %q: %v", tt.input, diagnostics)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("for %q expected\n%q\ngot\n%q", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"// only a comment", "// only a comment\n"},
+		{"let x = 1; // one\nlet y = 2;", "let x = 1; // one\nlet y = 2;\n"},
+		{"// about x\nlet x = 1;", "// about x\nlet x = 1;\n"},
+		{"let x = 1;\n\n\n\nlet y = 2;", "let x = 1;\n\nlet y = 2;\n"},
+		{"let x = 1;\n// end", "let x = 1;\n// end\n"},
+		{"let x = 1;\n\n/* block\n comment */\n\nlet y = 2;",
+			"let x = 1;\n\n/* block\n comment */\n\nlet y = 2;\n"},
+		{"if (a) { // why\nb\n}", "if (a) {\n\t// why\n\tb;\n}\n"},
+		{"if (a) {\nb // because\n}", "if (a) {\n\tb; // because\n}\n"},
+		{"if (a) {\nb\n// the end\n}\nc", "if (a) {\n\tb;\n\t// the end\n}\nc;\n"},
+		{"if (a) { b } // after\nc", "if (a) { b } // after\nc;\n"},
+		{"if (a) { /* inside */ b }", "if (a) {\n\t/* inside */\n\tb;\n}\n"},
+		{"let f = fn() {\n\n  a\n\n  b\n\n};", "let f = fn() {\n\ta;\n\n\tb;\n};\n"},
+		/* Comments inside a statement stay by the tokens they were written next to */
+		{"let x = [1, // one\n2, // two\n3];", "let x = [\n\t1, // one\n\t2, // two\n\t3,\n];\n"},
+		{"f(a, /* b */ c)", "f(a, /* b */ c);\n"},
+		{"fn(a /* first */, b) { a }", "fn(a /* first */, b) { a };\n"},
+		{"let h = {\"a\": 1, // a\n\"b\": /* bee */ 2};", "let h = {\n\t\"a\": 1, // a\n\t\"b\": /* bee */ 2,\n};\n"},
+		{"f(a, // first\n  // about b\n  b)", "f(\n\ta, // first\n\t// about b\n\tb,\n);\n"},
+		{"let x = [1,\n// only\n2];", "let x = [\n\t1,\n\t// only\n\t2,\n];\n"},
+		{"let f = fn(a, // the a\nb) { a }", "let f = fn(\n\ta, // the a\n\tb,\n) { a };\n"},
+		{"[ // start\n]", "[ // start\n];\n"},
+		{"f(/* none */)", "f(/* none */);\n"},
+		{"let x = 1 + // one\n2;", "let x = 1 + // one\n\t2;\n"},
+		{"a /* a */ + b", "a /* a */ + b;\n"},
+		{"let x = 1 /* one */;", "let x = 1 /* one */;\n"},
+		{"x[/* i */ 0]", "x[/* i */ 0];\n"},
+		{"if (x /* c */) { y } /* no */ else { z }", "if (x /* c */) { y } /* no */ else { z }\n"},
+		{"for (let i = 0; /* cond */ i < 3; i += 1) {}", "for (let i = 0; /* cond */ i < 3; i += 1) {}\n"},
+		{"let f = fn() /* why */ { 1 }", "let f = fn() /* why */ { 1 };\n"},
+		{"if (a) {\nf(b, // c\nd)\n}", "if (a) {\n\tf(\n\t\tb, // c\n\t\td,\n\t);\n}\n"},
+	}
+
+	for _, tt := range tests {
+		actual, diagnostics := Source("test.mc", tt.input)
+		if len(diagnostics) != 0 {
+			t.Errorf("unexpected diagnostics for %q: %v", tt.input, diagnostics)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("for %q expected\n%q\ngot\n%q", tt.input, tt.expected, actual)
+		}
+		checkFormatted(t, tt.input)
+	}
+}
+
+func TestParseErrorsAreReported(t *testing.T) {
+	input := "let = 1;"
+	actual, diagnostics := Source("test.mc", input)
+	if len(diagnostics) != 1 {
+		t.Fatalf("expected 1 diagnostic, got %v", diagnostics)
+	}
+	if actual != input {
+		t.Errorf("source with errors should be left alone. Got %q", actual)
+	}
+}
+
+func TestProgram(t *testing.T) {
+	p := parser.New(lexer.New("let f = fn(x) { x * (2 + 1) }; f(2)"))
+	program := p.ParseProgram()
+
+	expected := "let f = fn(x) {\n\tx * (2 + 1);\n};\nf(2);\n"
+	if actual := Program(program); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+/*
+checkFormatted checks that formatting keeps the program's meaning, and that
+formatted source stays as it is.
+*/
+func checkFormatted(t *testing.T, source string) {
+	before := parser.New(lexer.New(source))
+	program := before.ParseProgram()
+
+	formatted, diagnostics := Source("test.mc", source)
+	if len(diagnostics) != 0 {
+		if len(before.Errors()) == 0 {
+			t.Errorf("Source reported %v for %q, which parses", diagnostics, source)
+		}
+		return
+	}
+
+	after := parser.New(lexer.New(formatted))
+	reparsed := after.ParseProgram()
+	if len(after.Errors()) != 0 {
+		t.Errorf("formatting %q gave %q, which doesn't parse: %v",
+			source, formatted, after.Errors())
+		return
+	}
+	if reparsed.String() != program.String() {
+		t.Errorf("formatting %q changed its meaning from %q to %q",
+			source, program.String(), reparsed.String())
+	}
+	if before, after := commentsOf(source), commentsOf(formatted); !reflect.DeepEqual(before, after) {
+		t.Errorf("formatting %q gave %q, which has comments %q instead of %q",
+			source, formatted, after, before)
+	}
+	if again, _ := Source("test.mc", formatted); again != formatted {
+		t.Errorf("formatting %q isn't stable: %q then %q", source, formatted, again)
+	}
+}
+
+/* commentsOf lists the comments in source, in order */
+func commentsOf(source string) []string {
+	comments := []string{}
+	l := lexer.New(source, lexer.WithTrivia())
+	for {
+		tok := l.NextToken()
+		for _, trivia := range append(tok.Leading, tok.Trailing...) {
+			if trivia.Kind != token.WHITESPACE {
+				comments = append(comments, trivia.Text)
+			}
+		}
+		if tok.Type == token.EOF {
+			return comments
+		}
+	}
+}
+
+/* Every string literal in the parser and lexer tests is a test case */
+func TestFormattingTestInputs(t *testing.T) {
+	files := []string{
+		filepath.Join("..", "parser", "parser_test.go"),
+		filepath.Join("..", "lexer", "lexer_test.go"),
+	}
+
+	for _, file := range files {
+		f, err := goparser.ParseFile(gotoken.NewFileSet(), file, nil, 0)
+		if err != nil {
+			t.Fatalf("could not parse %s: %s", file, err)
+		}
+		goast.Inspect(f, func(n goast.Node) bool {
+			lit, ok := n.(*goast.BasicLit)
+			if ok && lit.Kind == gotoken.STRING {
+				input, err := strconv.Unquote(lit.Value)
+				if err != nil {
+					t.Fatalf("could not unquote %s: %s", lit.Value, err)
+				}
+				checkFormatted(t, input)
+			}
+			return true
+		})
+	}
+}
+
+func FuzzSource(f *testing.F) {
+	f.Add("let x = (1 + 2) * 3; // note")
+	f.Add("if (a) { b } else if (c) { d }; -1")
+	f.Add("let f = fn(x) {\n  /* c */\n  x ** -x ** 2\n};")
+	f.Add("let x = [1, // one\n2, /* two */ 3];\nf(a /* a */, // b\nb)")
+	f.Fuzz(func(t *testing.T, source string) {
+		checkFormatted(t, source)
+	})
+}
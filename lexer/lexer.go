@@ -2,28 +2,73 @@ package lexer
 
 import (
 	"fmt"
+	"github.com/cowlet/moncow/diagnostic"
 	"github.com/cowlet/moncow/token"
+	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
 var _ = fmt.Printf // TODO: delete when done
 
+/* Error codes are stable, so tools can match on them */
+const (
+	ErrIllegalCharacter    diagnostic.Code = "L0001"
+	ErrUnterminatedString  diagnostic.Code = "L0002"
+	ErrInvalidEscape       diagnostic.Code = "L0003"
+	ErrInvalidUTF8         diagnostic.Code = "L0004"
+	ErrUnterminatedComment diagnostic.Code = "L0005"
+)
+
 type Lexer struct {
 	input        string
+	filename     string
 	position     int  // current position in input (current rune start)
 	readPosition int  // current reading position in input (after current rune)
 	ch           rune // current char under examination
+	line         int  // line of the current char, starting at 1
+	column       int  // column of the current char in runes, starting at 1
+
+	diagnostics []diagnostic.Diagnostic // one for every ILLEGAL token, at least
+
+	preserveTrivia bool
+}
+
+type Option func(*Lexer)
+
+/*
+WithTrivia attaches whitespace and comments to the tokens around them, rather
+than throwing them away. Trivia up to the end of a token's line is trailing
+trivia for that token, and everything after is leading trivia for the next.
+*/
+func WithTrivia() Option {
+	return func(l *Lexer) {
+		l.preserveTrivia = true
+	}
 }
 
-func New(input string) *Lexer {
-	l := &Lexer{input: input}
+func New(input string, opts ...Option) *Lexer {
+	return NewWithFilename("", input, opts...)
+}
+
+/* NewWithFilename records filename in the position of every token */
+func NewWithFilename(filename, input string, opts ...Option) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
+	for _, opt := range opts {
+		opt(l)
+	}
 	l.readRune() // initialize the character pointers
 	return l
 }
 
 func (l *Lexer) readRune() {
-	if l.readPosition >= len(l.input) {
+	if l.readPosition > len(l.input) {
+		return // already at EOF, so stay put
+	}
+	l.advanceLineColumn()
+
+	if l.readPosition == len(l.input) {
 		l.ch = 0
 		l.position = l.readPosition
 		l.readPosition += 1
@@ -35,6 +80,51 @@ func (l *Lexer) readRune() {
 	}
 }
 
+/* Move line and column past the current char, which is about to be replaced */
+func (l *Lexer) advanceLineColumn() {
+	// treat \r\n as one line break, and a lone \r as a line break too
+	if l.ch == '\n' || (l.ch == '\r' && l.peekRune() != '\n') {
+		l.line += 1
+		l.column = 1
+	} else {
+		l.column += 1
+	}
+}
+
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.column,
+	}
+}
+
+/* Diagnostics gives the errors found so far, in the order they were found */
+func (l *Lexer) Diagnostics() []diagnostic.Diagnostic {
+	return l.diagnostics
+}
+
+/* errorf reports an error from start up to the end of the current char */
+func (l *Lexer) errorf(code diagnostic.Code, start token.Position, format string, a ...interface{}) {
+	span := diagnostic.Span{Start: start, End: l.positionAfter()}
+	l.diagnostics = append(l.diagnostics, diagnostic.Errorf(code, span, format, a...))
+}
+
+/* positionAfter gives the position just past the current char */
+func (l *Lexer) positionAfter() token.Position {
+	pos := l.currentPosition()
+	if !l.atEOF() {
+		pos.Offset = l.readPosition
+		pos.Column += 1
+	}
+	return pos
+}
+
+func (l *Lexer) atEOF() bool {
+	return l.position >= len(l.input)
+}
+
 func (l *Lexer) peekRune() rune {
 	if l.readPosition >= len(l.input) {
 		return 0
@@ -45,7 +135,7 @@ func (l *Lexer) peekRune() rune {
 
 func (l *Lexer) readIdentifier() string {
 	startPos := l.position
-	for isLetter(l.ch) {
+	for l.atLetter() {
 		l.readRune()
 	}
 	return l.input[startPos:l.position]
@@ -69,12 +159,190 @@ func (l *Lexer) readFloat() (string, bool) {
 	return l.input[startPos:l.position], true
 }
 
-func (l *Lexer) skipWhitespace() {
-	for unicode.Is(unicode.White_Space, l.ch) {
+/*
+readString decodes a double-quoted string, leaving the closing quote as the
+current char. It returns false if the string is unterminated.
+*/
+func (l *Lexer) readString() (string, bool) {
+	var out strings.Builder
+
+	l.readRune() // skip the opening quote
+	for {
+		switch {
+		case l.ch == '"':
+			return out.String(), true
+		case l.ch == 0 && l.atEOF():
+			return out.String(), false
+		case l.ch == '\\':
+			if r, ok := l.readEscape(); ok {
+				out.WriteRune(r)
+			}
+		case l.ch == utf8.RuneError && l.isInvalidUTF8():
+			// leave it out, so the decoded value is always valid UTF-8
+			l.errorf(ErrInvalidUTF8, l.currentPosition(), "Invalid UTF-8 in string literal")
+		default:
+			out.WriteRune(l.ch)
+		}
+		l.readRune()
+	}
+}
+
+func (l *Lexer) isInvalidUTF8() bool {
+	_, width := utf8.DecodeRuneInString(l.input[l.position:])
+	return width == 1
+}
+
+/*
+atLetter reports whether the current char can be part of an identifier. A byte
+that isn't valid UTF-8 reads as U+FFFD, which is a symbol, but it can't be one,
+or the identifier wouldn't survive being decoded and encoded again.
+*/
+func (l *Lexer) atLetter() bool {
+	return isLetter(l.ch) && !(l.ch == utf8.RuneError && l.isInvalidUTF8())
+}
+
+/*
+readEscape decodes the escape sequence starting at the current backslash,
+leaving the last char of the sequence as the current char. Supported escapes
+are \n, \t, \r, \", \\ and \u{1F42E}, which takes 1 to 6 hex digits.
+*/
+func (l *Lexer) readEscape() (rune, bool) {
+	start := l.currentPosition()
+	l.readRune() // skip the backslash
+
+	switch l.ch {
+	case 'n':
+		return '\n', true
+	case 't':
+		return '\t', true
+	case 'r':
+		return '\r', true
+	case '"':
+		return '"', true
+	case '\\':
+		return '\\', true
+	case 'u':
+		return l.readUnicodeEscape(start)
+	case 0:
+		if l.atEOF() {
+			return 0, false // reported as an unterminated string
+		}
+	}
+	l.errorf(ErrInvalidEscape, start, "Invalid escape sequence %q",
+		l.input[start.Offset:l.positionAfter().Offset])
+	return 0, false
+}
+
+func (l *Lexer) readUnicodeEscape(start token.Position) (rune, bool) {
+	if l.peekRune() != '{' {
+		l.errorf(ErrInvalidEscape, start, "Unicode escape must look like \\u{1F42E}")
+		return 0, false
+	}
+	l.readRune() // onto the '{'
+
+	digitsStart := l.readPosition
+	for isHexDigit(l.peekRune()) {
+		l.readRune()
+	}
+	digits := l.input[digitsStart:l.readPosition]
+	if l.peekRune() != '}' || len(digits) == 0 || len(digits) > 6 {
+		l.errorf(ErrInvalidEscape, start, "Unicode escape must look like \\u{1F42E}")
+		return 0, false
+	}
+	l.readRune() // onto the '}'
+
+	value, _ := strconv.ParseUint(digits, 16, 32)
+	r := rune(value)
+	if !utf8.ValidRune(r) {
+		l.errorf(ErrInvalidEscape, start, "Invalid code point U+%s in escape", digits)
+		return 0, false
+	}
+	return r, true
+}
+
+func isWhitespace(ch rune) bool {
+	return unicode.Is(unicode.White_Space, ch)
+}
+
+func isLineBreak(ch rune) bool {
+	return ch == '\n' || ch == '\r'
+}
+
+/*
+readTrivia skips whitespace and comments, returning them if they're being
+preserved. Trailing trivia stops short of the next line break.
+*/
+func (l *Lexer) readTrivia(trailing bool) []token.Trivia {
+	var trivia []token.Trivia
+
+	for {
+		start := l.currentPosition()
+		var kind token.TriviaKind
+
+		switch {
+		case isWhitespace(l.ch) && !(trailing && isLineBreak(l.ch)):
+			kind = token.WHITESPACE
+			for isWhitespace(l.ch) && !(trailing && isLineBreak(l.ch)) {
+				l.readRune()
+			}
+		case l.ch == '/' && l.peekRune() == '/':
+			kind = token.LINE_COMMENT
+			for !isLineBreak(l.ch) && !l.atEOF() {
+				l.checkCommentUTF8()
+				l.readRune()
+			}
+		case l.ch == '/' && l.peekRune() == '*':
+			kind = token.BLOCK_COMMENT
+			l.skipBlockComment(start)
+		default:
+			return trivia
+		}
+
+		if l.preserveTrivia {
+			trivia = append(trivia, token.Trivia{
+				Kind: kind,
+				Text: l.input[start.Offset:l.position],
+				Pos:  start,
+			})
+		}
+	}
+}
+
+/* skipBlockComment reads up to and including the star-slash that closes it */
+func (l *Lexer) skipBlockComment(start token.Position) {
+	depth := 0
+	for {
+		switch {
+		case l.atEOF():
+			l.errorf(ErrUnterminatedComment, start, "Unterminated block comment")
+			return
+		case l.ch == '/' && l.peekRune() == '*':
+			depth += 1
+			l.readRune()
+		case l.ch == '*' && l.peekRune() == '/':
+			depth -= 1
+			l.readRune()
+			if depth == 0 {
+				l.readRune()
+				return
+			}
+		default:
+			l.checkCommentUTF8()
+		}
 		l.readRune()
 	}
 }
 
+/*
+checkCommentUTF8 reports the current char if it's a byte that isn't valid
+UTF-8, as a comment's text has to be to survive being decoded and encoded again
+*/
+func (l *Lexer) checkCommentUTF8() {
+	if l.ch == utf8.RuneError && l.isInvalidUTF8() {
+		l.errorf(ErrInvalidUTF8, l.currentPosition(), "Invalid UTF-8 in comment")
+	}
+}
+
 func isLetter(ch rune) bool {
 	return unicode.In(ch, unicode.Letter, unicode.Symbol) || ch == '_'
 }
@@ -83,15 +351,30 @@ func isDigit(ch rune) bool {
 	return unicode.In(ch, unicode.Number)
 }
 
+func isHexDigit(ch rune) bool {
+	return ('0' <= ch && ch <= '9') || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
+}
+
 func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
 func (l *Lexer) NextToken() token.Token {
+	leading := l.readTrivia(false)
+	tok := l.readToken()
+	tok.End = l.currentPosition()
+	if l.preserveTrivia {
+		tok.Leading = leading
+		tok.Trailing = l.readTrivia(true)
+	}
+	return tok
+}
+
+func (l *Lexer) readToken() token.Token {
 	var tok token.Token
 
-	l.skipWhitespace()
 	//fmt.Printf("Inspecting rune %#U\n", l.ch)
+	pos := l.currentPosition()
 
 	switch l.ch {
 	case '=':
@@ -110,6 +393,8 @@ func (l *Lexer) NextToken() token.Token {
 		}
 	case ';':
 		tok = newToken(token.SEMI, l.ch)
+	case ':':
+		tok = newToken(token.COLON, l.ch)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -117,28 +402,97 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekRune() == '=' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.PLUS_ASSIGN, Literal: "+="}
+		} else {
+			tok = newToken(token.PLUS, l.ch)
+		}
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekRune() == '=' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.MINUS_ASSIGN, Literal: "-="}
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 	case '*':
-		tok = newToken(token.MULT, l.ch)
+		if l.peekRune() == '*' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.POW, Literal: "**"}
+		} else if l.peekRune() == '=' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.MULT_ASSIGN, Literal: "*="}
+		} else {
+			tok = newToken(token.MULT, l.ch)
+		}
 	case '/':
-		tok = newToken(token.DIV, l.ch)
+		if l.peekRune() == '=' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.DIV_ASSIGN, Literal: "/="}
+		} else {
+			tok = newToken(token.DIV, l.ch)
+		}
+	case '%':
+		tok = newToken(token.MOD, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekRune() == '=' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.LTE, Literal: "<="}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekRune() == '=' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.GTE, Literal: ">="}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
+	case '&':
+		if l.peekRune() == '&' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.AND, Literal: "&&"}
+		} else {
+			l.errorf(ErrIllegalCharacter, pos, "Illegal character %q, did you mean \"&&\"?", l.ch)
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '|':
+		if l.peekRune() == '|' {
+			l.readRune() // consume one here, the other below
+			tok = token.Token{Type: token.OR, Literal: "||"}
+		} else {
+			l.errorf(ErrIllegalCharacter, pos, "Illegal character %q, did you mean \"||\"?", l.ch)
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '{':
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
 		tok = newToken(token.RBRACE, l.ch)
+	case '[':
+		tok = newToken(token.LBRACKET, l.ch)
+	case ']':
+		tok = newToken(token.RBRACKET, l.ch)
+	case '"':
+		if value, ok := l.readString(); ok {
+			tok = token.Token{Type: token.STRING, Literal: value}
+		} else {
+			l.errorf(ErrUnterminatedString, pos, "Unterminated string literal")
+			tok = token.Token{Type: token.ILLEGAL, Literal: l.input[pos.Offset:]}
+		}
 	case 0:
+		if !l.atEOF() {
+			/* A NUL in the middle of the input doesn't end it */
+			l.errorf(ErrIllegalCharacter, pos, "Illegal character %q", l.ch)
+			tok = newToken(token.ILLEGAL, l.ch)
+			break
+		}
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
-		if isLetter(l.ch) {
+		if l.atLetter() {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Pos = pos
 			return tok
 		} else if isDigit(l.ch) {
 			val, ok := l.readFloat()
@@ -147,12 +501,18 @@ func (l *Lexer) NextToken() token.Token {
 			} else {
 				tok = token.Token{Type: token.INT, Literal: val}
 			}
+			tok.Pos = pos
 			return tok
+		} else if l.ch == utf8.RuneError && l.isInvalidUTF8() {
+			l.errorf(ErrInvalidUTF8, pos, "Invalid UTF-8 byte %#x", l.input[l.position])
+			tok = token.Token{Type: token.ILLEGAL, Literal: l.input[l.position:l.readPosition]}
 		} else {
+			l.errorf(ErrIllegalCharacter, pos, "Illegal character %q", l.ch)
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
 
 	l.readRune()
+	tok.Pos = pos
 	return tok
 }
@@ -1,8 +1,10 @@
 package lexer
 
 import (
+	"github.com/cowlet/moncow/diagnostic"
 	"github.com/cowlet/moncow/token"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestNextToken(t *testing.T) {
@@ -16,7 +18,7 @@ let add = fn(x, y) {
 };
 
 let result = add(five, ten);
-!-/*5;
+!-/ *5;
 5 < 10 > 5;
 
 if (5 < 10) {
@@ -135,3 +137,404 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "let horse🐴 = 3;\r\n  🐮 != 2.5\n\n}"
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedOffset int
+		expectedLine   int
+		expectedColumn int
+	}{
+		{token.LET, 0, 1, 1},
+		{token.IDENT, 4, 1, 5},
+		{token.ASSIGN, 14, 1, 12},
+		{token.INT, 16, 1, 14},
+		{token.SEMI, 17, 1, 15},
+		{token.IDENT, 22, 2, 3},
+		{token.NEQ, 27, 2, 5},
+		{token.FLOAT, 30, 2, 8},
+		{token.RBRACE, 35, 4, 1},
+		{token.EOF, 36, 4, 2},
+		{token.EOF, 36, 4, 2},
+	}
+
+	l := NewWithFilename("moo.mc", input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - TokenType wrong. Expected %q, got %q.",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos.Filename != "moo.mc" {
+			t.Fatalf("tests[%d] - Filename wrong. Expected %q, got %q.",
+				i, "moo.mc", tok.Pos.Filename)
+		}
+		if tok.Pos.Offset != tt.expectedOffset {
+			t.Fatalf("tests[%d] - Offset wrong. Expected %d, got %d.",
+				i, tt.expectedOffset, tok.Pos.Offset)
+		}
+		if tok.Pos.Line != tt.expectedLine || tok.Pos.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - Position wrong. Expected %d:%d, got %d:%d.",
+				i, tt.expectedLine, tt.expectedColumn, tok.Pos.Line, tok.Pos.Column)
+		}
+	}
+}
+
+func TestLoneCarriageReturn(t *testing.T) {
+	l := New("a\rb")
+	l.NextToken()
+	tok := l.NextToken()
+
+	if tok.Pos.String() != "2:1" {
+		t.Fatalf("Position wrong. Expected %q, got %q.", "2:1", tok.Pos.String())
+	}
+}
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{`"moo"`, token.STRING, "moo"},
+		{`""`, token.STRING, ""},
+		{`"moo cow"`, token.STRING, "moo cow"},
+		{`"horse🐴"`, token.STRING, "horse🐴"},
+		{`"a\nb\tc\rd"`, token.STRING, "a\nb\tc\rd"},
+		{`"say \"moo\""`, token.STRING, `say "moo"`},
+		{`"back\\slash"`, token.STRING, `back\slash`},
+		{`"\u{1F42E}!"`, token.STRING, "🐮!"},
+		{`"\u{41}\u{10FFFF}"`, token.STRING, "A\U0010FFFF"},
+		{"\"two\nlines\"", token.STRING, "two\nlines"},
+		{`"moo`, token.ILLEGAL, `"moo`},
+		{`"moo\"`, token.ILLEGAL, `"moo\"`},
+	}
+
+	for i, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - TokenType wrong. Expected %q, got %q.",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong. Expected %q, got %q.",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		if !utf8.ValidString(tok.Literal) {
+			t.Fatalf("tests[%d] - Literal %q is not valid UTF-8", i, tok.Literal)
+		}
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Fatalf("tests[%d] - Expected EOF after string, got %q", i, next.Type)
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedLiteral string
+		expectedCode    diagnostic.Code
+		expectedMessage string
+	}{
+		{`"moo`, `"moo`, ErrUnterminatedString, "1:1: Unterminated string literal"},
+		{`"m\qo"`, "mo", ErrInvalidEscape, `1:3: Invalid escape sequence "\\q"`},
+		{`"\u41"`, "41", ErrInvalidEscape, `1:2: Unicode escape must look like \u{1F42E}`},
+		{`"\u{}"`, "}", ErrInvalidEscape, `1:2: Unicode escape must look like \u{1F42E}`},
+		{`"\u{1234567}"`, "}", ErrInvalidEscape, `1:2: Unicode escape must look like \u{1F42E}`},
+		{`"\u{D800}"`, "", ErrInvalidEscape, "1:2: Invalid code point U+D800 in escape"},
+		{`"\u{110000}"`, "", ErrInvalidEscape, "1:2: Invalid code point U+110000 in escape"},
+		{"\"a\xffb\"", "ab", ErrInvalidUTF8, "1:3: Invalid UTF-8 in string literal"},
+		{"a\xceb", "\xce", ErrInvalidUTF8, "1:2: Invalid UTF-8 byte 0xce"},
+		{"\xff", "\xff", ErrInvalidUTF8, "1:1: Invalid UTF-8 byte 0xff"},
+		{"a\uFFFDb \xce", "\xce", ErrInvalidUTF8, "1:5: Invalid UTF-8 byte 0xce"},
+		{"x // \xce\n5", "5", ErrInvalidUTF8, "1:6: Invalid UTF-8 in comment"},
+		{"x /* \n\xce */ 5", "5", ErrInvalidUTF8, "2:1: Invalid UTF-8 in comment"},
+		{"x @", "@", ErrIllegalCharacter, `1:3: Illegal character '@'`},
+		{"x \x00 5", "\x00", ErrIllegalCharacter, `1:3: Illegal character '\x00'`},
+	}
+
+	for i, tt := range tests {
+		l := New(tt.input)
+		var tok token.Token
+		for tok = l.NextToken(); tok.Type == token.IDENT; tok = l.NextToken() {
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Errorf("tests[%d] - Literal wrong. Expected %q, got %q.",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		diags := l.Diagnostics()
+		if len(diags) != 1 {
+			t.Errorf("tests[%d] - Expected 1 diagnostic, got %d: %v", i, len(diags), diags)
+			continue
+		}
+		if diags[0].Code != tt.expectedCode {
+			t.Errorf("tests[%d] - Code wrong. Expected %s, got %s.",
+				i, tt.expectedCode, diags[0].Code)
+		}
+		if diags[0].String() != tt.expectedMessage {
+			t.Errorf("tests[%d] - Message wrong. Expected %q, got %q.",
+				i, tt.expectedMessage, diags[0].String())
+		}
+	}
+}
+
+func TestPositionAfterString(t *testing.T) {
+	l := New("\"a\nbc\" 🐮")
+	l.NextToken()
+	tok := l.NextToken()
+
+	if tok.Pos.String() != "2:5" || tok.Pos.Offset != 7 {
+		t.Fatalf("Position wrong. Expected 2:5 at offset 7, got %s at offset %d.",
+			tok.Pos, tok.Pos.Offset)
+	}
+}
+
+func TestTokenEnds(t *testing.T) {
+	l := New("\"a\\nb\\t\" 🐮 <= // moo")
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedOffset int
+		expectedColumn int
+	}{
+		{token.STRING, 8, 9}, // the source text, not the decoded string
+		{token.IDENT, 13, 11},
+		{token.LTE, 16, 14},
+		{token.EOF, 23, 21},
+	}
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - TokenType wrong. Expected %q, got %q.",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.End.Offset != tt.expectedOffset || tok.End.Column != tt.expectedColumn {
+			t.Errorf("tests[%d] - End wrong. Expected offset %d, column %d, got %d, %d.",
+				i, tt.expectedOffset, tt.expectedColumn, tok.End.Offset, tok.End.Column)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// a line comment
+let x = 5; // trailing
+/* block */ let /* inline */ y = x / 2;
+/* outer /* nested */ still outer */
+"// not a comment" /**/ 10
+// comment at EOF`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.INT, "5"},
+		{token.SEMI, ";"},
+		{token.LET, "let"},
+		{token.IDENT, "y"},
+		{token.ASSIGN, "="},
+		{token.IDENT, "x"},
+		{token.DIV, "/"},
+		{token.INT, "2"},
+		{token.SEMI, ";"},
+		{token.STRING, "// not a comment"},
+		{token.INT, "10"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - TokenType wrong. Expected %q, got %q.",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong. Expected %q, got %q.",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Leading != nil || tok.Trailing != nil {
+			t.Fatalf("tests[%d] - Trivia kept without WithTrivia", i)
+		}
+	}
+	if len(l.Diagnostics()) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", l.Diagnostics())
+	}
+}
+
+func TestUnterminatedComment(t *testing.T) {
+	l := New("x /* moo /* cow */")
+	l.NextToken()
+	tok := l.NextToken()
+
+	if tok.Type != token.EOF {
+		t.Fatalf("TokenType wrong. Expected EOF, got %q.", tok.Type)
+	}
+	diags := l.Diagnostics()
+	if len(diags) != 1 || diags[0].String() != "1:3: Unterminated block comment" {
+		t.Fatalf("expected an unterminated comment error, got %v", diags)
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	input := "// header\nlet x = 5; // five\r\n\t/* a\nb */ x /* after */\n"
+
+	type trivia struct {
+		kind token.TriviaKind
+		text string
+	}
+	tests := []struct {
+		expectedLiteral  string
+		expectedLeading  []trivia
+		expectedTrailing []trivia
+	}{
+		{"let", []trivia{
+			{token.LINE_COMMENT, "// header"},
+			{token.WHITESPACE, "\n"},
+		}, []trivia{{token.WHITESPACE, " "}}},
+		{"x", nil, []trivia{{token.WHITESPACE, " "}}},
+		{"=", nil, []trivia{{token.WHITESPACE, " "}}},
+		{"5", nil, nil},
+		{";", nil, []trivia{
+			{token.WHITESPACE, " "},
+			{token.LINE_COMMENT, "// five"},
+		}},
+		{"x", []trivia{
+			{token.WHITESPACE, "\r\n\t"},
+			{token.BLOCK_COMMENT, "/* a\nb */"},
+			{token.WHITESPACE, " "},
+		}, []trivia{
+			{token.WHITESPACE, " "},
+			{token.BLOCK_COMMENT, "/* after */"},
+		}},
+		{"", []trivia{{token.WHITESPACE, "\n"}}, nil},
+	}
+
+	l := New(input, WithTrivia())
+
+	check := func(i int, which string, expected []trivia, actual []token.Trivia) {
+		if len(actual) != len(expected) {
+			t.Fatalf("tests[%d] - %s trivia wrong. Expected %v, got %v.",
+				i, which, expected, actual)
+		}
+		for j, tr := range expected {
+			if actual[j].Kind != tr.kind || actual[j].Text != tr.text {
+				t.Fatalf("tests[%d] - %s trivia[%d] wrong. Expected %s %q, got %s %q.",
+					i, which, j, tr.kind, tr.text, actual[j].Kind, actual[j].Text)
+			}
+			if input[actual[j].Pos.Offset:actual[j].Pos.Offset+len(tr.text)] != tr.text {
+				t.Fatalf("tests[%d] - %s trivia[%d] has wrong position %s.",
+					i, which, j, actual[j].Pos)
+			}
+		}
+	}
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong. Expected %q, got %q.",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		check(i, "leading", tt.expectedLeading, tok.Leading)
+		check(i, "trailing", tt.expectedTrailing, tok.Trailing)
+	}
+}
+
+func TestMultiCharacterOperators(t *testing.T) {
+	input := "a <= b >= c && d || e % f ** g * h < i > j"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.LTE, "<="},
+		{token.IDENT, "b"},
+		{token.GTE, ">="},
+		{token.IDENT, "c"},
+		{token.AND, "&&"},
+		{token.IDENT, "d"},
+		{token.OR, "||"},
+		{token.IDENT, "e"},
+		{token.MOD, "%"},
+		{token.IDENT, "f"},
+		{token.POW, "**"},
+		{token.IDENT, "g"},
+		{token.MULT, "*"},
+		{token.IDENT, "h"},
+		{token.LT, "<"},
+		{token.IDENT, "i"},
+		{token.GT, ">"},
+		{token.IDENT, "j"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - TokenType wrong. Expected %q, got %q.",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong. Expected %q, got %q.",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	l = New("xs[0]")
+	for _, expected := range []token.TokenType{
+		token.IDENT, token.LBRACKET, token.INT, token.RBRACKET, token.EOF} {
+		if tok := l.NextToken(); tok.Type != expected {
+			t.Fatalf("TokenType wrong. Expected %q, got %q.", expected, tok.Type)
+		}
+	}
+
+	l = New(`{"a": 1}`)
+	for _, expected := range []token.TokenType{
+		token.LBRACE, token.STRING, token.COLON, token.INT, token.RBRACE, token.EOF} {
+		if tok := l.NextToken(); tok.Type != expected {
+			t.Fatalf("TokenType wrong. Expected %q, got %q.", expected, tok.Type)
+		}
+	}
+
+	l = New("a += b -= c *= d /= e = f ** g")
+	for _, expected := range []token.TokenType{
+		token.IDENT, token.PLUS_ASSIGN, token.IDENT, token.MINUS_ASSIGN, token.IDENT,
+		token.MULT_ASSIGN, token.IDENT, token.DIV_ASSIGN, token.IDENT, token.ASSIGN,
+		token.IDENT, token.POW, token.IDENT, token.EOF} {
+		if tok := l.NextToken(); tok.Type != expected {
+			t.Fatalf("TokenType wrong. Expected %q, got %q.", expected, tok.Type)
+		}
+	}
+
+	l = New("while for break continue whilst")
+	for _, expected := range []token.TokenType{
+		token.WHILE, token.FOR, token.BREAK, token.CONTINUE, token.IDENT, token.EOF} {
+		if tok := l.NextToken(); tok.Type != expected {
+			t.Fatalf("TokenType wrong. Expected %q, got %q.", expected, tok.Type)
+		}
+	}
+
+	l = New("a & b | c")
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+	if len(l.Diagnostics()) != 2 {
+		t.Fatalf("expected 2 illegal characters, got %v", l.Diagnostics())
+	}
+}
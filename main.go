@@ -7,7 +7,27 @@ import (
 	"os/user"
 )
 
+const usage = `Usage:
+  moncow               start the REPL
+  moncow fmt [flags] [path ...]
+                       format MonCow source
+  moncow ast [--format=sexpr|dot] [file]
+                       print the parse tree
+`
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fmt":
+			os.Exit(runFmt(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "ast":
+			os.Exit(runAST(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n%s", os.Args[1], usage)
+			os.Exit(2)
+		}
+	}
+
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
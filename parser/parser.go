@@ -3,33 +3,90 @@ package parser
 import (
 	"fmt"
 	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/diagnostic"
 	"github.com/cowlet/moncow/lexer"
 	"github.com/cowlet/moncow/token"
+	"io"
 	"strconv"
 )
 
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // x = y, x += y
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
 	EQUALS      // ==
-	LESSGREATER // >, <
+	LESSGREATER // >, <, >=, <=
 	SUM         // +, -
-	PRODUCT     // *, /
+	PRODUCT     // *, /, %
 	PREFIX      // -x, !x
+	EXPONENT    // x ** y, binding tighter than prefix so -x ** y is -(x ** y)
 	CALL        // fn(x)
+	INDEX       // xs[i]
 )
 
 var precedences = map[token.TokenType]int{
-	token.EQ:    EQUALS,
-	token.NEQ:   EQUALS,
-	token.LT:    LESSGREATER,
-	token.GT:    LESSGREATER,
-	token.PLUS:  SUM,
-	token.MINUS: SUM,
-	token.MULT:  PRODUCT,
-	token.DIV:   PRODUCT,
+	token.ASSIGN:       ASSIGN,
+	token.PLUS_ASSIGN:  ASSIGN,
+	token.MINUS_ASSIGN: ASSIGN,
+	token.MULT_ASSIGN:  ASSIGN,
+	token.DIV_ASSIGN:   ASSIGN,
+
+	token.OR:       LOGICAL_OR,
+	token.AND:      LOGICAL_AND,
+	token.EQ:       EQUALS,
+	token.NEQ:      EQUALS,
+	token.LT:       LESSGREATER,
+	token.GT:       LESSGREATER,
+	token.LTE:      LESSGREATER,
+	token.GTE:      LESSGREATER,
+	token.PLUS:     SUM,
+	token.MINUS:    SUM,
+	token.MULT:     PRODUCT,
+	token.DIV:      PRODUCT,
+	token.MOD:      PRODUCT,
+	token.POW:      EXPONENT,
+	token.LPAREN:   CALL,
+	token.LBRACKET: INDEX,
+}
+
+/* Operators not listed here are left-associative */
+var rightAssociative = map[token.TokenType]bool{
+	token.POW: true,
+
+	token.ASSIGN:       true,
+	token.PLUS_ASSIGN:  true,
+	token.MINUS_ASSIGN: true,
+	token.MULT_ASSIGN:  true,
+	token.DIV_ASSIGN:   true,
+}
+
+/* Precedence is how tightly an infix operator binds, or LOWEST for other tokens */
+func Precedence(t token.TokenType) int {
+	if p, ok := precedences[t]; ok {
+		return p
+	}
+	return LOWEST
 }
 
+func RightAssociative(t token.TokenType) bool {
+	return rightAssociative[t]
+}
+
+/* Error codes are stable, so tools can match on them */
+const (
+	ErrUnexpectedToken diagnostic.Code = "P0001"
+	ErrNoPrefixParseFn diagnostic.Code = "P0002"
+	ErrUnclosedParen   diagnostic.Code = "P0003"
+	ErrInvalidInteger  diagnostic.Code = "P0004"
+	ErrInvalidBoolean  diagnostic.Code = "P0005"
+	ErrInvalidFloat    diagnostic.Code = "P0006"
+	ErrUnclosedBlock   diagnostic.Code = "P0007"
+	ErrOutsideLoop     diagnostic.Code = "P0008"
+	ErrInvalidTarget   diagnostic.Code = "P0009"
+)
+
 type (
 	prefixParseFn func() ast.Expression
 	infixParseFn  func(ast.Expression) ast.Expression
@@ -39,16 +96,29 @@ type Parser struct {
 	l            *lexer.Lexer
 	currentToken token.Token
 	peekToken    token.Token
-	errors       []string
+	diagnostics  []diagnostic.Diagnostic
+
+	lexerDiagnostics int // how many of the lexer's diagnostics we've seen
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	loopDepth int // how many loops enclose the current token, within its function
+
+	builder     SyntaxBuilder // nil unless building a syntax tree too
+	recordedEOF bool
+
+	tracer     io.Writer // nil unless tracing
+	traceDepth int
 }
 
-func New(l *lexer.Lexer) *Parser {
+func New(l *lexer.Lexer, opts ...Option) *Parser {
 	p := &Parser{
-		l:      l,
-		errors: []string{},
+		l:           l,
+		diagnostics: []diagnostic.Diagnostic{},
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
 	/* Read two tokens into current and peek */
 	p.nextToken()
@@ -56,26 +126,44 @@ func New(l *lexer.Lexer) *Parser {
 
 	/* Set up operator functions */
 	p.prefixParseFns = map[token.TokenType]prefixParseFn{
-		token.IDENT:  p.parseIdentifier,
-		token.INT:    p.parseIntegerLiteral,
-		token.FLOAT:  p.parseFloatLiteral,
-		token.BANG:   p.parsePrefixExpression,
-		token.MINUS:  p.parsePrefixExpression,
-		token.TRUE:   p.parseBoolean,
-		token.FALSE:  p.parseBoolean,
-		token.LPAREN: p.parseGroupedExpression,
-		token.IF:     p.parseIfExpression,
+		token.IDENT:    p.parseIdentifier,
+		token.INT:      p.parseIntegerLiteral,
+		token.FLOAT:    p.parseFloatLiteral,
+		token.STRING:   p.parseStringLiteral,
+		token.BANG:     p.parsePrefixExpression,
+		token.MINUS:    p.parsePrefixExpression,
+		token.TRUE:     p.parseBoolean,
+		token.FALSE:    p.parseBoolean,
+		token.LPAREN:   p.parseGroupedExpression,
+		token.IF:       p.parseIfExpression,
+		token.FUNC:     p.parseFunctionLiteral,
+		token.LBRACKET: p.parseArrayLiteral,
+		token.LBRACE:   p.parseHashLiteral,
 	}
 
 	p.infixParseFns = map[token.TokenType]infixParseFn{
-		token.PLUS:  p.parseInfixExpression,
-		token.MINUS: p.parseInfixExpression,
-		token.MULT:  p.parseInfixExpression,
-		token.DIV:   p.parseInfixExpression,
-		token.EQ:    p.parseInfixExpression,
-		token.NEQ:   p.parseInfixExpression,
-		token.GT:    p.parseInfixExpression,
-		token.LT:    p.parseInfixExpression,
+		token.PLUS:     p.parseInfixExpression,
+		token.MINUS:    p.parseInfixExpression,
+		token.MULT:     p.parseInfixExpression,
+		token.DIV:      p.parseInfixExpression,
+		token.EQ:       p.parseInfixExpression,
+		token.NEQ:      p.parseInfixExpression,
+		token.GT:       p.parseInfixExpression,
+		token.LT:       p.parseInfixExpression,
+		token.LTE:      p.parseInfixExpression,
+		token.GTE:      p.parseInfixExpression,
+		token.MOD:      p.parseInfixExpression,
+		token.POW:      p.parseInfixExpression,
+		token.AND:      p.parseInfixExpression,
+		token.OR:       p.parseInfixExpression,
+		token.LPAREN:   p.parseCallExpression,
+		token.LBRACKET: p.parseIndexExpression,
+
+		token.ASSIGN:       p.parseAssignExpression,
+		token.PLUS_ASSIGN:  p.parseAssignExpression,
+		token.MINUS_ASSIGN: p.parseAssignExpression,
+		token.MULT_ASSIGN:  p.parseAssignExpression,
+		token.DIV_ASSIGN:   p.parseAssignExpression,
 	}
 
 	return p
@@ -84,28 +172,64 @@ func New(l *lexer.Lexer) *Parser {
 func (p *Parser) nextToken() {
 	p.currentToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+	p.record(p.currentToken)
+
+	/* Pass on anything the lexer found wrong while reading that token */
+	lexed := p.l.Diagnostics()
+	for _, d := range lexed[p.lexerDiagnostics:] {
+		p.report(d)
+	}
+	p.lexerDiagnostics = len(lexed)
 }
 
 func (p *Parser) precedence(tt token.Token) int {
-	if p, ok := precedences[tt.Type]; ok {
-		return p
-	}
-	return LOWEST
+	return Precedence(tt.Type)
+}
+
+func (p *Parser) Diagnostics() []diagnostic.Diagnostic {
+	return p.diagnostics
 }
 
+/* Errors gives each diagnostic in its one-line "file:line:col: message" form */
 func (p *Parser) Errors() []string {
-	return p.errors
+	errors := []string{}
+	for _, d := range p.diagnostics {
+		errors = append(errors, d.String())
+	}
+	return errors
+}
+
+func (p *Parser) report(d diagnostic.Diagnostic) {
+	p.diagnostics = append(p.diagnostics, d)
+}
+
+/* errorAt reports an error spanning the given token */
+func (p *Parser) errorAt(tok token.Token, code diagnostic.Code, format string, a ...interface{}) {
+	p.report(diagnostic.Errorf(code, diagnostic.TokenSpan(tok), format, a...))
+}
+
+func (p *Parser) unexpectedTokenError(t token.TokenType, found token.Token) {
+	d := diagnostic.Errorf(ErrUnexpectedToken, diagnostic.TokenSpan(found),
+		"Expected token type %s, got %s instead", t, found.Type)
+	d.Expected = []token.TokenType{t}
+	d.Found = found.Type
+	p.report(d)
 }
 
 func (p *Parser) tokenError(t token.TokenType) {
-	msg := fmt.Sprintf("Expected token type %s, got %s instead",
-		t, p.currentToken.Type)
-	p.errors = append(p.errors, msg)
+	p.unexpectedTokenError(t, p.currentToken)
+}
+
+func (p *Parser) peekError(t token.TokenType) {
+	p.unexpectedTokenError(t, p.peekToken)
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("No prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	if t == token.ILLEGAL {
+		return // the lexer has already reported it
+	}
+	p.errorAt(p.currentToken, ErrNoPrefixParseFn,
+		"No prefix parse function for %s found", t)
 }
 
 func (p *Parser) validateToken(t token.TokenType) (token.Token, bool) {
@@ -119,6 +243,16 @@ func (p *Parser) validateToken(t token.TokenType) (token.Token, bool) {
 	return tok, ok
 }
 
+/* expectPeek advances only if the next token is of the expected type */
+func (p *Parser) expectPeek(t token.TokenType) bool {
+	if p.peekToken.Type != t {
+		p.peekError(t)
+		return false
+	}
+	p.nextToken()
+	return true
+}
+
 func (p *Parser) parseLetStatement() *ast.LetStatement {
 	/* Expect LET, IDENT, ASSIGN, <expression>, SEMI */
 	let, ok := p.validateToken(token.LET)
@@ -135,12 +269,14 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 		return nil
 	}
 
-	/* TODO: revisit */
-	for p.currentToken.Type != token.SEMI {
+	value := p.parseExpression(LOWEST)
+	if value == nil {
+		return nil
+	}
+	if p.peekToken.Type == token.SEMI {
 		p.nextToken()
 	}
-	//expression := p.parseExpression()
-	return &ast.LetStatement{Token: let, Name: ident} // skip Value
+	return &ast.LetStatement{Token: let, Name: ident, Value: value}
 }
 
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
@@ -150,17 +286,155 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 		return nil
 	}
 
-	/* TODO: revisit */
-	for p.currentToken.Type != token.SEMI {
+	/* A bare `return;` has no value */
+	if p.currentToken.Type == token.SEMI {
+		return &ast.ReturnStatement{Token: ret}
+	}
+
+	value := p.parseExpression(LOWEST)
+	if value == nil {
+		return nil
+	}
+	if p.peekToken.Type == token.SEMI {
+		p.nextToken()
+	}
+	return &ast.ReturnStatement{Token: ret, Value: value}
+}
+
+func (p *Parser) parseWhileStatement() *ast.WhileStatement {
+	/* Expect WHILE, LPAREN, <expression>, RPAREN, <block> */
+	tok, ok := p.validateToken(token.WHILE)
+	if !ok {
+		return nil
+	}
+
+	ws := &ast.WhileStatement{Token: tok}
+	if p.currentToken.Type != token.LPAREN {
+		p.tokenError(token.LPAREN)
+		return nil
+	}
+	ws.Condition = p.parseCondition()
+	if ws.Condition == nil {
+		return nil
+	}
+	p.nextToken() // consume the RPAREN
+	ws.Body = p.parseLoopBody()
+	if ws.Body == nil {
+		return nil
+	}
+	if p.peekToken.Type == token.SEMI {
 		p.nextToken()
 	}
-	//expression := p.parseExpression()
-	return &ast.ReturnStatement{Token: ret} // skip Value
+	return ws
+}
+
+func (p *Parser) parseForStatement() *ast.ForStatement {
+	/* Expect FOR, LPAREN, [init] SEMI, [condition] SEMI, [post] RPAREN, <block> */
+	tok, ok := p.validateToken(token.FOR)
+	if !ok {
+		return nil
+	}
+	if _, ok := p.validateToken(token.LPAREN); !ok {
+		return nil
+	}
+
+	fs := &ast.ForStatement{Token: tok}
+	if p.currentToken.Type != token.SEMI {
+		fs.Init = p.parseForInit()
+		if fs.Init == nil {
+			return nil
+		}
+		/* The init statement consumes the SEMI, if there is one */
+		if p.currentToken.Type != token.SEMI {
+			p.peekError(token.SEMI)
+			return nil
+		}
+	}
+	p.nextToken() // consume the SEMI
+
+	if p.currentToken.Type != token.SEMI {
+		fs.Condition = p.parseExpression(LOWEST)
+		if fs.Condition == nil || !p.expectPeek(token.SEMI) {
+			return nil
+		}
+	}
+	p.nextToken() // consume the SEMI
+
+	if p.currentToken.Type != token.RPAREN {
+		fs.Post = p.parseExpression(LOWEST)
+		if fs.Post == nil || !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	}
+	p.nextToken() // consume the RPAREN
+
+	fs.Body = p.parseLoopBody()
+	if fs.Body == nil {
+		return nil
+	}
+	if p.peekToken.Type == token.SEMI {
+		p.nextToken()
+	}
+	return fs
+}
+
+/* parseForInit never returns a typed nil, as Init is an interface */
+func (p *Parser) parseForInit() (stmt ast.Statement) {
+	mark := p.mark()
+	defer func() { p.wrap(mark, stmt) }()
+
+	if p.currentToken.Type == token.LET {
+		if stmt := p.parseLetStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
+	}
+	if stmt := p.parseExpressionStatement(); stmt != nil {
+		return stmt
+	}
+	return nil
+}
+
+func (p *Parser) parseLoopBody() *ast.BlockStatement {
+	p.loopDepth++
+	defer func() { p.loopDepth-- }()
+	return p.parseBlockStatement()
+}
+
+/*
+break and continue are syntactically fine anywhere, so outside a loop they're
+reported but still returned, and parsing carries on without resyncing.
+*/
+func (p *Parser) parseBreakStatement() *ast.BreakStatement {
+	stmt := &ast.BreakStatement{Token: p.currentToken}
+	p.checkInLoop(stmt.Token)
+	if p.peekToken.Type == token.SEMI {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseContinueStatement() *ast.ContinueStatement {
+	stmt := &ast.ContinueStatement{Token: p.currentToken}
+	p.checkInLoop(stmt.Token)
+	if p.peekToken.Type == token.SEMI {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) checkInLoop(tok token.Token) {
+	if p.loopDepth == 0 {
+		p.errorAt(tok, ErrOutsideLoop, "'%s' is not inside a loop", tok.Literal)
+	}
 }
 
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.currentToken}
 	stmt.Expression = p.parseExpression(LOWEST)
+	if stmt.Expression == nil {
+		return nil
+	}
 
 	if p.peekToken.Type == token.SEMI {
 		p.nextToken()
@@ -169,58 +443,184 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	return stmt
 }
 
-func (p *Parser) parseExpression(precedence int) ast.Expression {
+func (p *Parser) parseExpression(precedence int) (leftExp ast.Expression) {
+	p.trace("parseExpression %s", precedenceName(precedence))
+	defer func() { p.untrace(leftExp) }()
+
 	prefix := p.prefixParseFns[p.currentToken.Type]
 	if prefix == nil {
 		p.noPrefixParseFnError(p.currentToken.Type)
 		return nil
 	}
-	leftExp := prefix()
+	p.trace("prefix %s %q at %s", p.currentToken.Type,
+		p.currentToken.Literal, p.currentToken.Pos)
+	mark := p.mark()
+	leftExp = prefix()
+	p.untrace(leftExp)
+	p.wrap(mark, leftExp)
+	return p.continueExpression(leftExp, precedence, mark)
+}
+
+/*
+continueExpression applies infix operators to an already parsed left operand,
+which began at mark.
+*/
+func (p *Parser) continueExpression(leftExp ast.Expression, precedence int, mark int) ast.Expression {
+	/* A nil from any parse function means an error has already been reported */
+	for leftExp != nil && p.peekToken.Type != token.SEMI {
+		peekPrecedence := p.precedence(p.peekToken)
+		if precedence >= peekPrecedence {
+			p.tracef("peek %s: %s <= %s, so stop", p.peekToken.Type,
+				precedenceName(peekPrecedence), precedenceName(precedence))
+			break
+		}
+		p.tracef("peek %s: %s > %s, so continue", p.peekToken.Type,
+			precedenceName(peekPrecedence), precedenceName(precedence))
 
-	for p.peekToken.Type != token.SEMI && precedence < p.precedence(p.peekToken) {
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExp
 		}
 
 		p.nextToken()
+		p.trace("infix %s %q at %s", p.currentToken.Type,
+			p.currentToken.Literal, p.currentToken.Pos)
 		leftExp = infix(leftExp)
+		p.untrace(leftExp)
+		p.wrap(mark, leftExp)
 	}
 
 	return leftExp
 }
 
 func (p *Parser) parseGroupedExpression() ast.Expression {
+	lparen := p.currentToken
 	p.nextToken() // consume the LPAREN
 	exp := p.parseExpression(LOWEST)
+	if exp == nil {
+		return nil
+	}
 	if p.peekToken.Type != token.RPAREN {
-		msg := fmt.Sprintf("Failed to find ')', got %q instead", p.peekToken.Literal)
-		p.errors = append(p.errors, msg)
+		d := diagnostic.Errorf(ErrUnclosedParen, diagnostic.TokenSpan(p.peekToken),
+			"Failed to find ')', got %q instead", p.peekToken.Literal)
+		d.Expected = []token.TokenType{token.RPAREN}
+		d.Found = p.peekToken.Type
+		d.Notes = []string{fmt.Sprintf("'(' opened at %s", lparen.Pos)}
+		p.report(d)
 		return nil
 	}
 	p.nextToken() // advance onto the RPAREN
-	return exp
+	return &ast.ParenExpression{Token: lparen, Expression: exp, Rparen: p.currentToken}
+}
+
+/*
+parseCondition parses the bracketed condition of an if or a while. The
+brackets are part of the statement's syntax, so the condition is what's inside.
+*/
+func (p *Parser) parseCondition() ast.Expression {
+	pe, ok := p.parseGroupedExpression().(*ast.ParenExpression)
+	if !ok {
+		return nil
+	}
+	return pe.Expression
 }
 
-func (p *Parser) parseBlockStatement() *ast.BlockStatement {
+func (p *Parser) parseBlockStatement() (result *ast.BlockStatement) {
+	mark := p.mark()
+	defer func() { p.wrap(mark, result) }()
+
 	blk := &ast.BlockStatement{Token: p.currentToken}
 
 	_, ok := p.validateToken(token.LBRACE)
 	if !ok {
 		return nil
 	}
-	for p.currentToken.Type != token.RBRACE {
-		statement := p.parseStatement()
+	blk.Statements = p.parseStatementsUntil(token.RBRACE)
+	return p.closeBlock(blk)
+}
 
-		if statement != nil {
-			blk.Statements = append(blk.Statements, statement)
+/* closeBlock checks that a block's statements ended at its RBRACE */
+func (p *Parser) closeBlock(blk *ast.BlockStatement) *ast.BlockStatement {
+	if p.currentToken.Type != token.RBRACE {
+		d := diagnostic.Errorf(ErrUnclosedBlock, diagnostic.TokenSpan(p.currentToken),
+			"Failed to find '}', got %s instead", p.currentToken.Type)
+		d.Expected = []token.TokenType{token.RBRACE}
+		d.Found = p.currentToken.Type
+		d.Notes = []string{fmt.Sprintf("'{' opened at %s", blk.Token.Pos)}
+		p.report(d)
+		return nil
+	}
+	// Leave the RBRACE as the current token, like any other expression end
+	blk.Rbrace = p.currentToken
+	return blk
+}
+
+/*
+parseBlockOrHash decides what a '{' at the start of a statement means. It's a
+hash literal if it's empty or its first expression is followed by ':', and a
+block statement otherwise. Anywhere else, a '{' in an expression is always a
+hash literal, and blocks are only parsed where the grammar demands one.
+*/
+func (p *Parser) parseBlockOrHash() ast.Statement {
+	lbrace := p.currentToken
+	mark := p.mark()
+
+	switch p.peekToken.Type {
+	case token.RBRACE:
+		if stmt := p.parseExpressionStatement(); stmt != nil {
+			p.wrap(mark, stmt)
+			return stmt
+		}
+		return nil
+	case token.LET, token.RETURN, token.WHILE, token.FOR,
+		token.BREAK, token.CONTINUE, token.LBRACE:
+		/* A hash can't be a hash key, so '{{' must start a nested block */
+		if blk := p.parseBlockStatement(); blk != nil {
+			return blk
 		}
+		return nil
+	}
+
+	p.nextToken() // consume the LBRACE
+	first := p.currentToken
+	firstMark := p.mark()
+	exp := p.parseExpression(LOWEST)
+	if exp == nil {
+		return nil
+	}
+
+	if p.peekToken.Type == token.COLON {
+		hash := p.parseHashPairs(&ast.HashLiteral{Token: lbrace}, exp)
+		p.wrap(mark, hash)
+		if hash == nil {
+			return nil
+		}
+		exp = p.continueExpression(hash, LOWEST, mark)
+		if exp == nil {
+			return nil
+		}
+		stmt := &ast.ExpressionStatement{Token: lbrace, Expression: exp}
+		if p.peekToken.Type == token.SEMI {
+			p.nextToken()
+		}
+		p.wrap(mark, stmt)
+		return stmt
+	}
+
+	/* A block whose first statement we've already parsed */
+	blk := &ast.BlockStatement{Token: lbrace}
+	blk.Statements = []ast.Statement{&ast.ExpressionStatement{Token: first, Expression: exp}}
+	if p.peekToken.Type == token.SEMI {
 		p.nextToken()
 	}
-	_, ok = p.validateToken(token.RBRACE)
-	if !ok {
+	p.wrap(firstMark, blk.Statements[0])
+	p.nextToken()
+	blk.Statements = append(blk.Statements, p.parseStatementsUntil(token.RBRACE)...)
+	if p.closeBlock(blk) == nil {
+		p.wrap(mark, nil)
 		return nil
 	}
+	p.wrap(mark, blk)
 	return blk
 }
 
@@ -231,19 +631,215 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	}
 
 	ie := &ast.IfExpression{Token: tok}
-	ie.Condition = p.parseGroupedExpression() // surrounded by brackets
-	p.nextToken()                             // consume the RPAREN
+	if p.currentToken.Type != token.LPAREN {
+		p.tokenError(token.LPAREN)
+		return nil
+	}
+	ie.Condition = p.parseCondition()
+	if ie.Condition == nil {
+		return nil
+	}
+	p.nextToken() // consume the RPAREN
 	ie.IfBlock = p.parseBlockStatement()
+	if ie.IfBlock == nil {
+		return nil
+	}
 
 	// Is there an else?
-	if p.currentToken.Type == token.ELSE {
-		p.nextToken() // consume the else
-		ie.ElseBlock = p.parseBlockStatement()
+	if p.peekToken.Type != token.ELSE {
+		return ie
+	}
+	p.nextToken() // advance onto the else
+	p.nextToken() // consume the else
+
+	/* Assign only non-nil results, as ElseBlock is an interface */
+	if p.currentToken.Type == token.IF {
+		alt, _ := p.parseIfExpression().(*ast.IfExpression)
+		if alt == nil {
+			return nil
+		}
+		ie.ElseBlock = alt
+	} else {
+		alt := p.parseBlockStatement()
+		if alt == nil {
+			return nil
+		}
+		ie.ElseBlock = alt
+	}
+
+	return ie
+}
+
+func (p *Parser) parseFunctionLiteral() ast.Expression {
+	tok, ok := p.validateToken(token.FUNC)
+	if !ok {
+		return nil
+	}
+
+	fl := &ast.FunctionLiteral{Token: tok}
+	fl.Parameters, ok = p.parseFunctionParameters()
+	if !ok {
+		return nil
+	}
+
+	/* A loop outside the function can't be broken out of from inside it */
+	outerLoops := p.loopDepth
+	p.loopDepth = 0
+	fl.Body = p.parseBlockStatement()
+	p.loopDepth = outerLoops
+	if fl.Body == nil {
+		return nil
+	}
+	return fl
+}
+
+func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, bool) {
+	/* Expect LPAREN, zero or more comma-separated IDENTs, RPAREN */
+	params := []*ast.Identifier{}
+
+	_, ok := p.validateToken(token.LPAREN)
+	if !ok {
+		return nil, false
+	}
+	if p.currentToken.Type == token.RPAREN {
+		p.nextToken() // consume the RPAREN
+		return params, true
+	}
+
+	for {
+		name, ok := p.validateToken(token.IDENT)
+		if !ok {
+			return nil, false
+		}
+		params = append(params, &ast.Identifier{Token: name, Value: name.Literal})
+
+		if p.currentToken.Type != token.COMMA {
+			break
+		}
+		p.nextToken() // consume the COMMA
+		if p.currentToken.Type == token.RPAREN {
+			break // trailing comma
+		}
+	}
+
+	_, ok = p.validateToken(token.RPAREN)
+	if !ok {
+		return nil, false
+	}
+	return params, true
+}
+
+func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
+	ce := &ast.CallExpression{Token: p.currentToken, Function: function}
+	ce.Arguments = p.parseExpressionList(token.RPAREN)
+	if ce.Arguments == nil {
+		return nil
+	}
+	ce.Rparen = p.currentToken
+	return ce
+}
+
+func (p *Parser) parseArrayLiteral() ast.Expression {
+	al := &ast.ArrayLiteral{Token: p.currentToken}
+	al.Elements = p.parseExpressionList(token.RBRACKET)
+	if al.Elements == nil {
+		return nil
+	}
+	al.Rbracket = p.currentToken
+	return al
+}
+
+func (p *Parser) parseHashLiteral() ast.Expression {
+	hash := p.parseHashPairs(&ast.HashLiteral{Token: p.currentToken}, nil)
+	if hash == nil {
+		return nil
+	}
+	return hash
+}
+
+/*
+parseHashPairs parses "key: value" pairs up to the RBRACE, allowing a trailing
+comma. If the first key has already been parsed, pass it in as key, and the
+current token should be its last one.
+*/
+func (p *Parser) parseHashPairs(hash *ast.HashLiteral, key ast.Expression) *ast.HashLiteral {
+	hash.Pairs = []ast.HashPair{}
+
+	for key != nil || p.peekToken.Type != token.RBRACE {
+		if key == nil {
+			p.nextToken() // consume the LBRACE or COMMA
+			key = p.parseExpression(LOWEST)
+			if key == nil {
+				return nil
+			}
+		}
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
+		p.nextToken() // consume the COLON
+		value := p.parseExpression(LOWEST)
+		if value == nil {
+			return nil
+		}
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
+		key = nil
+
+		if p.peekToken.Type != token.COMMA {
+			break
+		}
+		p.nextToken() // advance onto the COMMA
 	}
 
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+	hash.Rbrace = p.currentToken
+	return hash
+}
+
+func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
+	ie := &ast.IndexExpression{Token: p.currentToken, Left: left}
+
+	p.nextToken() // consume the LBRACKET
+	ie.Index = p.parseExpression(LOWEST)
+	if ie.Index == nil {
+		return nil
+	}
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+	ie.Rbracket = p.currentToken
 	return ie
 }
 
+/*
+parseExpressionList parses comma-separated expressions from the current
+opening token up to the end token, allowing a trailing comma. It returns nil
+if there was an error.
+*/
+func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
+	list := []ast.Expression{}
+
+	for p.peekToken.Type != end {
+		p.nextToken() // consume the opening token or COMMA
+		exp := p.parseExpression(LOWEST)
+		if exp == nil {
+			return nil
+		}
+		list = append(list, exp)
+
+		if p.peekToken.Type != token.COMMA {
+			break
+		}
+		p.nextToken() // advance onto the COMMA
+	}
+
+	if !p.expectPeek(end) {
+		return nil
+	}
+	return list
+}
+
 func (p *Parser) parseIdentifier() ast.Expression {
 	return &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
 }
@@ -253,8 +849,8 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 
 	value, err := strconv.ParseInt(p.currentToken.Literal, 0, 64)
 	if err != nil {
-		msg := fmt.Sprintf("Could not parse %q as integer", p.currentToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorAt(p.currentToken, ErrInvalidInteger, "Could not parse %q as integer",
+			p.currentToken.Literal)
 		return nil
 	}
 	lit.Value = value
@@ -266,8 +862,8 @@ func (p *Parser) parseBoolean() ast.Expression {
 
 	value, err := strconv.ParseBool(p.currentToken.Literal)
 	if err != nil {
-		msg := fmt.Sprintf("Could not parse %q as Boolean", p.currentToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorAt(p.currentToken, ErrInvalidBoolean, "Could not parse %q as Boolean",
+			p.currentToken.Literal)
 		return nil
 	}
 	b.Value = value
@@ -279,14 +875,18 @@ func (p *Parser) parseFloatLiteral() ast.Expression {
 
 	value, err := strconv.ParseFloat(p.currentToken.Literal, 64)
 	if err != nil {
-		msg := fmt.Sprintf("Could not parse %q as float", p.currentToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorAt(p.currentToken, ErrInvalidFloat, "Could not parse %q as float",
+			p.currentToken.Literal)
 		return nil
 	}
 	lit.Value = value
 	return lit
 }
 
+func (p *Parser) parseStringLiteral() ast.Expression {
+	return &ast.StringLiteral{Token: p.currentToken, Value: p.currentToken.Literal}
+}
+
 func (p *Parser) parsePrefixExpression() ast.Expression {
 	pe := &ast.PrefixExpression{
 		Token:    p.currentToken,
@@ -294,6 +894,9 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 	}
 	p.nextToken()
 	pe.Right = p.parseExpression(PREFIX)
+	if pe.Right == nil {
+		return nil
+	}
 
 	return pe
 }
@@ -305,36 +908,139 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 		Left:     left,
 	}
 	precedence := p.precedence(p.currentToken)
+	if rightAssociative[p.currentToken.Type] {
+		/* Let an operator of the same precedence take the right operand */
+		precedence -= 1
+	}
 	p.nextToken()
 	ie.Right = p.parseExpression(precedence)
+	if ie.Right == nil {
+		return nil
+	}
 
 	return ie
 }
 
-func (p *Parser) parseStatement() ast.Statement {
-	fmt.Printf("Parsing statement beginning '%s'\n", p.currentToken.Type)
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression {
+	ae := &ast.AssignExpression{
+		Token:    p.currentToken,
+		Operator: p.currentToken.Literal,
+		Target:   target,
+	}
+
+	/* Only something that names a storage location can be assigned to */
+	switch ast.Unparen(target).(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		p.errorAt(ae.Token, ErrInvalidTarget,
+			"Cannot assign to %s, only to a name or an index expression", target)
+		return nil
+	}
+
+	/* Right-associative, so a = b = c is a = (b = c) */
+	precedence := p.precedence(p.currentToken)
+	if rightAssociative[p.currentToken.Type] {
+		precedence -= 1
+	}
+	p.nextToken()
+	ae.Value = p.parseExpression(precedence)
+	if ae.Value == nil {
+		return nil
+	}
+
+	return ae
+}
+
+func (p *Parser) parseStatement() (stmt ast.Statement) {
+	p.trace("parseStatement %s at %s", p.currentToken.Type, p.currentToken.Pos)
+	defer func() { p.untrace(stmt) }()
+
+	if p.currentToken.Type == token.LBRACE {
+		return p.parseBlockOrHash() // which reports its own syntax nodes
+	}
+	mark := p.mark()
+	defer func() { p.wrap(mark, stmt) }()
+
+	/* Check for nil here, so callers never see a typed nil Statement */
 	switch p.currentToken.Type {
 	case token.LET:
-		return p.parseLetStatement()
+		if stmt := p.parseLetStatement(); stmt != nil {
+			return stmt
+		}
 	case token.RETURN:
-		return p.parseReturnStatement()
+		if stmt := p.parseReturnStatement(); stmt != nil {
+			return stmt
+		}
+	case token.WHILE:
+		if stmt := p.parseWhileStatement(); stmt != nil {
+			return stmt
+		}
+	case token.FOR:
+		if stmt := p.parseForStatement(); stmt != nil {
+			return stmt
+		}
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
 	default:
-		return p.parseExpressionStatement()
+		if stmt := p.parseExpressionStatement(); stmt != nil {
+			return stmt
+		}
 	}
+	return nil
 }
 
-func (p *Parser) ParseProgram() *ast.Program {
-	program := &ast.Program{}
-	program.Statements = []ast.Statement{}
+/*
+parseStatementsUntil parses statements up to the end token or EOF, whichever
+comes first, and leaves that token as the current one. A statement that fails
+to parse is dropped, and parsing picks up again after the next sync point, so
+that one pass can report several errors.
+*/
+func (p *Parser) parseStatementsUntil(end token.TokenType) []ast.Statement {
+	statements := []ast.Statement{}
 
-	for p.currentToken.Type != token.EOF {
+	for p.currentToken.Type != end && p.currentToken.Type != token.EOF {
+		start := p.currentToken.Pos.Offset
 		statement := p.parseStatement()
 
 		if statement != nil {
-			fmt.Printf("Parsed statement %q\n", statement.String())
-			program.Statements = append(program.Statements, statement)
+			statements = append(statements, statement)
+			p.nextToken()
+			continue
+		}
+
+		p.synchronize(end)
+		if p.currentToken.Pos.Offset == start {
+			p.nextToken() // always make progress, e.g. past a stray '}'
+		}
+	}
+	return statements
+}
+
+/*
+synchronize skips tokens after an error until the current token is one a new
+statement could start at: just after a ';', at a statement keyword, or at the
+end token or EOF that closes the enclosing statement list.
+*/
+func (p *Parser) synchronize(end token.TokenType) {
+	for {
+		switch p.currentToken.Type {
+		case end, token.EOF, token.LET, token.RETURN,
+			token.WHILE, token.FOR, token.BREAK, token.CONTINUE:
+			return
+		case token.SEMI:
+			p.nextToken()
+			return
 		}
 		p.nextToken()
 	}
+}
+
+func (p *Parser) ParseProgram() *ast.Program {
+	program := &ast.Program{}
+	mark := p.mark()
+	program.Statements = p.parseStatementsUntil(token.EOF)
+	p.wrapKind(mark, "Program")
 	return program
 }
@@ -1,11 +1,17 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/diagnostic"
 	"github.com/cowlet/moncow/lexer"
 	"github.com/cowlet/moncow/token"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func checkParserErrors(t *testing.T, p *Parser) {
@@ -45,10 +51,11 @@ let moo = 12345;
 
 	tests := []struct {
 		expectedIdentifier string
+		expectedValue      interface{}
 	}{
-		{"x"},
-		{"y"},
-		{"moo"},
+		{"x", 5},
+		{"y", 10.3},
+		{"moo", 12345},
 	}
 
 	for i, tt := range tests {
@@ -56,6 +63,34 @@ let moo = 12345;
 		if !testLetStatement(t, stmt, tt.expectedIdentifier) {
 			return
 		}
+		value := stmt.(*ast.LetStatement).Value
+		if !testLiteralExpression(t, value, tt.expectedValue) {
+			return
+		}
+	}
+}
+
+func TestLetStatementExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		name     string
+		expected string
+	}{
+		{"let x = 5 * (2 + y);", "x", "let x = (5*(2+y));"},
+		{"let y = -moo", "y", "let y = (-moo);"},
+		{"let z = if (a) { b } else { c };", "z", "let z = (if a then { b; } else { c; });"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, 1)
+
+		if !testLetStatement(t, program.Statements[0], tt.name) {
+			return
+		}
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
 	}
 }
 
@@ -91,8 +126,9 @@ return 10.5;
 return 12345;
 `
 	program := initParser(t, input, 3)
+	expectedValues := []interface{}{5, 10.5, 12345}
 
-	for _, stmt := range program.Statements {
+	for i, stmt := range program.Statements {
 		retStmt, ok := stmt.(*ast.ReturnStatement)
 		if !ok {
 			t.Errorf("statement not *ast.ReturnStatement. Got %T", retStmt)
@@ -101,6 +137,31 @@ return 12345;
 		if stmt.TokenLiteral() != "return" {
 			t.Errorf("stmt.TokenLiteral not 'return', got %q", stmt.TokenLiteral())
 		}
+		if !testLiteralExpression(t, retStmt.Value, expectedValues[i]) {
+			return
+		}
+	}
+}
+
+func TestReturnStatementExpressions(t *testing.T) {
+	tests := []struct {
+		input         string
+		numStatements int
+		expected      string
+	}{
+		{"return a + b * c;", 1, "return (a+(b*c));"},
+		{"return;", 1, "return ;"},
+		{"return; moo", 2, "return ;moo"},
+		{"return x", 1, "return x;"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, tt.numStatements)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
 	}
 }
 
@@ -333,6 +394,12 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"5 < 5;", 5, "<", 5},
 		{"5 == 5;", 5, "==", 5},
 		{"5 != 5;", 5, "!=", 5},
+		{"5 <= 5;", 5, "<=", 5},
+		{"5 >= 5;", 5, ">=", 5},
+		{"5 % 5;", 5, "%", 5},
+		{"5 ** 5;", 5, "**", 5},
+		{"true && false;", true, "&&", false},
+		{"true || false;", true, "||", false},
 		{"5.8 + 1.2;", 5.8, "+", 1.2},
 		{"5 + 5.4;", 5, "+", 5.4},
 		{"moo + hoof;", "moo", "+", "hoof"},
@@ -427,6 +494,46 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"!(true == true)",
 			"(!(true==true))",
 		},
+		{
+			"a <= b == c >= d",
+			"((a<=b)==(c>=d))",
+		},
+		{
+			"a + b % c * d",
+			"(a+((b%c)*d))",
+		},
+		{
+			"a || b && c || d",
+			"((a||(b&&c))||d)",
+		},
+		{
+			"a == b && c != d || !e",
+			"(((a==b)&&(c!=d))||(!e))",
+		},
+		{
+			"2 ** 3 ** 2",
+			"(2**(3**2))",
+		},
+		{
+			"a * b ** c * d",
+			"((a*(b**c))*d)",
+		},
+		{
+			"-a ** b",
+			"(-(a**b))",
+		},
+		{
+			"a ** -b",
+			"(a**(-b))",
+		},
+		{
+			"(a ** b) ** c",
+			"((a**b)**c)",
+		},
+		{
+			"f(a) ** g(b) ** c",
+			"(f(a)**(g(b)**c))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -518,10 +625,12 @@ func testBlock(t *testing.T, blk *ast.BlockStatement, stmts []ast.Statement) boo
 }
 
 func TestIfExpression(t *testing.T) {
-	tokx := token.Token{token.IDENT, "x"}
-	toky := token.Token{token.IDENT, "y"}
-	expx := &ast.ExpressionStatement{tokx, &ast.Identifier{tokx, "x"}}
-	expy := &ast.ExpressionStatement{toky, &ast.Identifier{toky, "y"}}
+	tokx := token.Token{Type: token.IDENT, Literal: "x"}
+	toky := token.Token{Type: token.IDENT, Literal: "y"}
+	expx := &ast.ExpressionStatement{Token: tokx,
+		Expression: &ast.Identifier{Token: tokx, Value: "x"}}
+	expy := &ast.ExpressionStatement{Token: toky,
+		Expression: &ast.Identifier{Token: toky, Value: "y"}}
 
 	tests := []struct {
 		input     string
@@ -573,9 +682,1016 @@ func TestIfExpression(t *testing.T) {
 			return
 		}
 
-		if !testBlock(t, exp.ElseBlock, tt.elseblk) {
+		elseblk, _ := exp.ElseBlock.(*ast.BlockStatement)
+		if !testBlock(t, elseblk, tt.elseblk) {
 			return
 		}
 	}
 
 }
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"(1 + 2",
+			"moo.mc:1:7: Failed to find ')', got \"\" instead",
+		},
+		{
+			"x;\n  ;",
+			"moo.mc:2:3: No prefix parse function for ; found",
+		},
+		{
+			"if (🐮) { x } else y",
+			"moo.mc:1:19: Expected token type {, got IDENT instead",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewWithFilename("moo.mc", tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("expected errors for %q, got none", tt.input)
+			continue
+		}
+		if errors[0] != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, errors[0])
+		}
+	}
+}
+
+func TestFunctionLiteralParsing(t *testing.T) {
+	input := "fn(x, y) { x + y; }"
+	program := initParser(t, input, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("statement not ast.ExpressionStatement. Got %T",
+			program.Statements[0])
+	}
+	function, ok := stmt.Expression.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Expression not ast.FunctionLiteral. Got %T",
+			stmt.Expression)
+	}
+
+	if len(function.Parameters) != 2 {
+		t.Fatalf("function.Parameters wrong. Expected 2, got %d",
+			len(function.Parameters))
+	}
+	testLiteralExpression(t, function.Parameters[0], "x")
+	testLiteralExpression(t, function.Parameters[1], "y")
+
+	if len(function.Body.Statements) != 1 {
+		t.Fatalf("function.Body.Statements wrong. Expected 1, got %d",
+			len(function.Body.Statements))
+	}
+	bodyStmt, ok := function.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("function body statement not ast.ExpressionStatement. Got %T",
+			function.Body.Statements[0])
+	}
+	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
+}
+
+func TestFunctionParameterParsing(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedParams []string
+	}{
+		{"fn() {};", []string{}},
+		{"fn(x) {};", []string{"x"}},
+		{"fn(x, y, moo) {};", []string{"x", "y", "moo"}},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, 1)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function := stmt.Expression.(*ast.FunctionLiteral)
+
+		if len(function.Parameters) != len(tt.expectedParams) {
+			t.Errorf("length of parameters wrong. Expected %d, got %d",
+				len(tt.expectedParams), len(function.Parameters))
+		}
+		for i, ident := range tt.expectedParams {
+			testLiteralExpression(t, function.Parameters[i], ident)
+		}
+	}
+}
+
+func TestCallExpressionParsing(t *testing.T) {
+	input := "add(1, 2 * 3, 4 + 5);"
+	program := initParser(t, input, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("statement not ast.ExpressionStatement. Got %T",
+			program.Statements[0])
+	}
+	exp, ok := stmt.Expression.(*ast.CallExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression not ast.CallExpression. Got %T",
+			stmt.Expression)
+	}
+
+	if !testIdentifier(t, exp.Function, "add") {
+		return
+	}
+	if len(exp.Arguments) != 3 {
+		t.Fatalf("wrong length of arguments. Expected 3, got %d",
+			len(exp.Arguments))
+	}
+	testLiteralExpression(t, exp.Arguments[0], 1)
+	testInfixExpression(t, exp.Arguments[1], 2, "*", 3)
+	testInfixExpression(t, exp.Arguments[2], 4, "+", 5)
+}
+
+func TestFunctionsAndCalls(t *testing.T) {
+	tests := []struct {
+		input         string
+		numStatements int
+		expected      string
+	}{
+		{
+			"let add = fn(x, y) { x + y; }; add(five, ten);",
+			2,
+			"let add = fn(x, y) { (x+y); };add(five, ten)",
+		},
+		{"a + add(b * c) + d", 1, "((a+add((b*c)))+d)"},
+		{
+			"add(a, b, 1, 2 * 3, 4 + 5, add(6, 7 * 8))",
+			1,
+			"add(a, b, 1, (2*3), (4+5), add(6, (7*8)))",
+		},
+		{"add(a + b + c * d / f + g)", 1, "add((((a+b)+((c*d)/f))+g))"},
+		{"fn(x) { x }(5)", 1, "fn(x) { x; }(5)"},
+		{"-f()", 1, "(-f())"},
+		{"if (x) { f } else { g }(1)", 1, "(if x then { f; } else { g; })(1)"},
+		{"if (x) { 1 } y", 2, "(if x then { 1; })y"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, tt.numStatements)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		input    string
+		code     diagnostic.Code
+		expected []token.TokenType
+		found    token.TokenType
+		notes    int
+	}{
+		{"let = 5;", ErrUnexpectedToken, []token.TokenType{token.IDENT}, token.ASSIGN, 0},
+		{"add(1, 2", ErrUnexpectedToken, []token.TokenType{token.RPAREN}, token.EOF, 0},
+		{"(1 + 2", ErrUnclosedParen, []token.TokenType{token.RPAREN}, token.EOF, 1},
+		{"*5", ErrNoPrefixParseFn, nil, "", 0},
+		{"99999999999999999999", ErrInvalidInteger, nil, "", 0},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		diags := p.Diagnostics()
+		if len(diags) == 0 {
+			t.Errorf("expected diagnostics for %q, got none", tt.input)
+			continue
+		}
+		d := diags[0]
+		if d.Severity != diagnostic.Error {
+			t.Errorf("%q: expected severity error, got %s", tt.input, d.Severity)
+		}
+		if d.Code != tt.code {
+			t.Errorf("%q: expected code %s, got %s", tt.input, tt.code, d.Code)
+		}
+		if len(d.Expected) != len(tt.expected) ||
+			(len(tt.expected) > 0 && d.Expected[0] != tt.expected[0]) {
+			t.Errorf("%q: expected Expected %v, got %v", tt.input, tt.expected, d.Expected)
+		}
+		if d.Found != tt.found {
+			t.Errorf("%q: expected Found %q, got %q", tt.input, tt.found, d.Found)
+		}
+		if len(d.Notes) != tt.notes {
+			t.Errorf("%q: expected %d notes, got %v", tt.input, tt.notes, d.Notes)
+		}
+		if p.Errors()[0] != d.String() {
+			t.Errorf("%q: Errors() %q doesn't match %q", tt.input, p.Errors()[0], d.String())
+		}
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors []string
+		expected       string // the statements that survived
+	}{
+		{
+			"let = 1; let x 2; 5 +; let y = 3;",
+			[]string{
+				"1:5: Expected token type IDENT, got = instead",
+				"1:16: Expected token type =, got INT instead",
+				"1:22: No prefix parse function for ; found",
+			},
+			"let y = 3;",
+		},
+		{
+			"if (x) { 1",
+			[]string{"1:11: Failed to find '}', got EOF instead"},
+			"",
+		},
+		{
+			"let x = 5",
+			[]string{},
+			"let x = 5;",
+		},
+		{
+			"fn(x { x }; moo",
+			[]string{"1:6: Expected token type ), got { instead"},
+			"moo",
+		},
+		{
+			"} x; ) y",
+			[]string{
+				"1:1: No prefix parse function for } found",
+				"1:6: No prefix parse function for ) found",
+			},
+			"",
+		},
+		{
+			"if (a) { let = 1; b } c",
+			[]string{"1:14: Expected token type IDENT, got = instead"},
+			"(if a then { b; })c",
+		},
+		{
+			"add(1, 2 let z = 3",
+			[]string{"1:10: Expected token type ), got LET instead"},
+			"let z = 3;",
+		},
+		{
+			"break; while (x) { continue } continue;",
+			[]string{
+				"1:1: 'break' is not inside a loop",
+				"1:31: 'continue' is not inside a loop",
+			},
+			"break;while x { continue;; }continue;",
+		},
+		{
+			"for (let i = 0 i) {}; x",
+			[]string{"1:16: Expected token type ;, got IDENT instead"},
+			"x",
+		},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != len(tt.expectedErrors) {
+			t.Errorf("%q: expected %d errors, got %d: %q",
+				tt.input, len(tt.expectedErrors), len(errors), errors)
+			continue
+		}
+		for i, msg := range tt.expectedErrors {
+			if errors[i] != msg {
+				t.Errorf("%q: expected error %q, got %q", tt.input, msg, errors[i])
+			}
+		}
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+/* parseWithTimeout fails the test if ParseProgram doesn't return promptly */
+func parseWithTimeout(t *testing.T, input string) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		New(lexer.New(input)).ParseProgram()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ParseProgram did not terminate on %q", input)
+	}
+}
+
+func TestParseProgramTerminates(t *testing.T) {
+	inputs := []string{
+		"",
+		"if (x) { 1",
+		"if (x) {",
+		"if (",
+		"let x = 5",
+		"let x =",
+		"let",
+		"return",
+		"fn(",
+		"fn(x, y) { x + y",
+		"add(1, 2",
+		"{{{{",
+		"}}}}",
+		"((((",
+		"))))",
+		"; ; ;",
+		"let x = if (a) { fn() { return",
+		"\x00",
+		"\xff\xfe",
+	}
+
+	for _, input := range inputs {
+		parseWithTimeout(t, input)
+	}
+}
+
+func FuzzParseProgram(f *testing.F) {
+	seeds := []string{
+		"let x = 5 * (2 + y);",
+		"let add = fn(x, y) { x + y; }; add(five, ten);",
+		"if (x < y) { x } else { y }",
+		"return -a * b;",
+		"!(true == false)",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		parseWithTimeout(t, input)
+	})
+}
+
+func TestTrace(t *testing.T) {
+	var out bytes.Buffer
+	p := New(lexer.New("-a * b;"), WithTrace(&out))
+	p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := `parseStatement - at 1:1
+  parseExpression LOWEST
+    prefix - "-" at 1:1
+      parseExpression PREFIX
+        prefix IDENT "a" at 1:2
+        => *ast.Identifier a
+        peek *: PRODUCT <= PREFIX, so stop
+      => *ast.Identifier a
+    => *ast.PrefixExpression (-a)
+    peek *: PRODUCT > LOWEST, so continue
+    infix * "*" at 1:4
+      parseExpression PRODUCT
+        prefix IDENT "b" at 1:6
+        => *ast.Identifier b
+      => *ast.Identifier b
+    => *ast.InfixExpression ((-a)*b)
+  => *ast.InfixExpression ((-a)*b)
+=> *ast.ExpressionStatement ((-a)*b)
+`
+	if out.String() != expected {
+		t.Errorf("trace wrong. Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestNoTraceByDefault(t *testing.T) {
+	p := New(lexer.New("let x = 1 + 2;"))
+	p.ParseProgram()
+	if p.tracer != nil || p.traceDepth != 0 {
+		t.Errorf("expected no tracing, got tracer %v at depth %d",
+			p.tracer, p.traceDepth)
+	}
+}
+
+/* longChain is an expression with n uses of op, like 1 + 1 + 1 */
+func longChain(op string, n int) string {
+	return "1" + strings.Repeat(" "+op+" 1", n)
+}
+
+func TestLongExpressionChains(t *testing.T) {
+	/*
+		Parsing should do work in proportion to the length, so a chain twice as
+		long takes about twice as many allocations, however fast the machine is
+	*/
+	for _, op := range []string{"+", "-", "**", "=="} {
+		allocs := func(n int) float64 {
+			input := longChain(op, n)
+			return testing.AllocsPerRun(5, func() {
+				p := New(lexer.New(input))
+				p.ParseProgram()
+				checkParserErrors(t, p)
+			})
+		}
+		if short, long := allocs(400), allocs(800); long > 2.5*short {
+			t.Errorf("Parsing a chain of %s took %.0f allocations for 400 terms, but %.0f for 800", op, short, long)
+		}
+	}
+}
+
+func BenchmarkLongExpressionChain(b *testing.B) {
+	input := longChain("+", 1600)
+	for i := 0; i < b.N; i++ {
+		New(lexer.New(input)).ParseProgram()
+	}
+}
+
+func TestStringLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		value    string
+		expected string
+	}{
+		{`"moo cow";`, "moo cow", `"moo cow"`},
+		{`"say \"moo\"\n"`, "say \"moo\"\n", `"say \"moo\"\n"`},
+		{`"🐮\u{7}"`, "🐮\a", `"🐮\u{7}"`},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, 1)
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		literal, ok := stmt.Expression.(*ast.StringLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.StringLiteral. Got %T", stmt.Expression)
+		}
+		if literal.Value != tt.value {
+			t.Errorf("literal.Value not %q. Got %q", tt.value, literal.Value)
+		}
+		if literal.String() != tt.expected {
+			t.Errorf("literal.String() not %q. Got %q", tt.expected, literal.String())
+		}
+	}
+
+	program := initParser(t, `let s = "a" + "b";`, 1)
+	if program.String() != `let s = ("a"+"b");` {
+		t.Errorf("expected %q, got %q", `let s = ("a"+"b");`, program.String())
+	}
+}
+
+func TestLexerErrorsAreReported(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`let s = "moo`, []string{"1:9: Unterminated string literal"}},
+		{`let s = "m\qo"; s`, []string{`1:11: Invalid escape sequence "\\q"`}},
+		{"let x = @;", []string{"1:9: Illegal character '@'"}},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != len(tt.expected) {
+			t.Errorf("%q: expected %d errors, got %d: %q",
+				tt.input, len(tt.expected), len(errors), errors)
+			continue
+		}
+		for i, msg := range tt.expected {
+			if errors[i] != msg {
+				t.Errorf("%q: expected error %q, got %q", tt.input, msg, errors[i])
+			}
+		}
+	}
+}
+
+func TestCommentsAreIgnored(t *testing.T) {
+	input := `// leading comment
+let x = 5 /* five */ * 2; // trailing comment
+/* a /* nested */ comment */ x`
+
+	program := initParser(t, input, 2)
+	if program.String() != "let x = (5*2);x" {
+		t.Errorf("expected %q, got %q", "let x = (5*2);x", program.String())
+	}
+}
+
+func TestArrayLiteralParsing(t *testing.T) {
+	program := initParser(t, "[1, 2 * 2, 3 + 3]", 1)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	array, ok := stmt.Expression.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.ArrayLiteral. Got %T", stmt.Expression)
+	}
+	if len(array.Elements) != 3 {
+		t.Fatalf("len(array.Elements) not 3. Got %d", len(array.Elements))
+	}
+	testIntegerLiteral(t, array.Elements[0], 1)
+	testInfixExpression(t, array.Elements[1], 2, "*", 2)
+	testInfixExpression(t, array.Elements[2], 3, "+", 3)
+}
+
+func TestIndexExpressionParsing(t *testing.T) {
+	program := initParser(t, "xs[1 + 1]", 1)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	indexExp, ok := stmt.Expression.(*ast.IndexExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.IndexExpression. Got %T", stmt.Expression)
+	}
+	if !testIdentifier(t, indexExp.Left, "xs") {
+		return
+	}
+	testInfixExpression(t, indexExp.Index, 1, "+", 1)
+}
+
+func TestArraysAndTrailingCommas(t *testing.T) {
+	tests := []struct {
+		input         string
+		numStatements int
+		expected      string
+	}{
+		{"let xs = [1, 2.5, true]; xs[0]", 2, "let xs = [1, 2.5, true];(xs[0])"},
+		{"[]", 1, "[]"},
+		{"[1,]", 1, "[1]"},
+		{"[\n  1,\n  2,\n]", 1, "[1, 2]"},
+		{"add(1, 2,)", 1, "add(1, 2)"},
+		{"fn(x, y,) { x }", 1, "fn(x, y) { x; }"},
+		{"[[1], [2, 3]][1][0]", 1, "(([[1], [2, 3]][1])[0])"},
+		{"a * [1, 2, 3, 4][b * c] * d", 1, "((a*([1, 2, 3, 4][(b*c)]))*d)"},
+		{"add(a * b[2], b[1], 2 * [1, 2][1])", 1, "add((a*(b[2])), (b[1]), (2*([1, 2][1])))"},
+		{"fs[0](1)", 1, "(fs[0])(1)"},
+		{"-xs[0] ** 2", 1, "(-((xs[0])**2))"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, tt.numStatements)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+
+	for _, input := range []string{"[,]", "[1,,2]", "add(,)", "fn(,) {}", "xs[]", "[1, 2"} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected errors for %q, got none", input)
+		}
+	}
+}
+
+func TestHashLiteralParsing(t *testing.T) {
+	program := initParser(t, `{"a": 1, 2: true, "b": 3 + 4}`, 1)
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	hash, ok := stmt.Expression.(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("expression is not ast.HashLiteral. Got %T", stmt.Expression)
+	}
+	if len(hash.Pairs) != 3 {
+		t.Fatalf("hash has wrong number of pairs. Got %d", len(hash.Pairs))
+	}
+
+	if key, ok := hash.Pairs[0].Key.(*ast.StringLiteral); !ok || key.Value != "a" {
+		t.Errorf("first key is not \"a\". Got %T (%+v)", hash.Pairs[0].Key, hash.Pairs[0].Key)
+	}
+	testIntegerLiteral(t, hash.Pairs[0].Value, 1)
+	testIntegerLiteral(t, hash.Pairs[1].Key, 2)
+	testBoolean(t, hash.Pairs[1].Value, true)
+	testInfixExpression(t, hash.Pairs[2].Value, 3, "+", 4)
+}
+
+func TestHashLiteralsAndBlocks(t *testing.T) {
+	tests := []struct {
+		input         string
+		numStatements int
+		expected      string
+	}{
+		{"{}", 1, "{}"},
+		{"{ }", 1, "{}"},
+		{"let h = {};", 1, "let h = {};"},
+		{`{"a": 1, 2: true}`, 1, `{"a": 1, 2: true}`},
+		{`{"b": 2, "a": 1}`, 1, `{"b": 2, "a": 1}`},
+		{`{"a": {"b": {}}, "c": [{}]}`, 1, `{"a": {"b": {}}, "c": [{}]}`},
+		{"{\n  1: 2,\n  3: 4,\n}", 1, "{1: 2, 3: 4}"},
+		{`{a + b: c * d}`, 1, `{(a+b): (c*d)}`},
+		{`{"a": 1}["a"] + 1`, 1, `(({"a": 1}["a"])+1)`},
+		{`{"a": 1}; x`, 2, `{"a": 1}x`},
+		{`f({1: 2}, {})`, 1, `f({1: 2}, {})`},
+		{`if (x) { {} }`, 1, `(if x then { {}; })`},
+		{`fn() { {"a": 1} }`, 1, `fn() { {"a": 1}; }`},
+		{"{ x }", 1, "{ x; }"},
+		{"{ x; y }", 1, "{ x; y; }"},
+		{"{ let x = 1; x }", 1, "{ let x = 1;; x; }"},
+		{"{ return 1; }", 1, "{ return 1;; }"},
+		{"{ x } y", 2, "{ x; }y"},
+		{"{ { x } }", 1, "{ { x; }; }"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, tt.numStatements)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+
+	for _, input := range []string{`let h = {"a" 1}`, `{"a": }`, `{"a": 1,, }`, `{"a": 1`, `{,}`, `{ x`} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected errors for %q, got none", input)
+		}
+	}
+}
+
+func TestElseIfChains(t *testing.T) {
+	program := initParser(t, "if (a) { x } else if (b) { y } else if (c) { z } else { w }", 1)
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+	exp, ok := stmt.Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.IfExpression. Got %T", stmt.Expression)
+	}
+	for _, cond := range []string{"a", "b", "c"} {
+		if !testIdentifier(t, exp.Condition, cond) {
+			return
+		}
+		next, ok := exp.ElseBlock.(*ast.IfExpression)
+		if !ok {
+			if cond != "c" {
+				t.Fatalf("else of %q is not ast.IfExpression. Got %T", cond, exp.ElseBlock)
+			}
+			break
+		}
+		exp = next
+	}
+	last, ok := exp.ElseBlock.(*ast.BlockStatement)
+	if !ok {
+		t.Fatalf("final else is not ast.BlockStatement. Got %T", exp.ElseBlock)
+	}
+	if last.String() != "{ w; }" {
+		t.Errorf("final else wrong. Got %q", last.String())
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (a) { x } else if (b) { y }",
+			"(if a then { x; } else if b then { y; })"},
+		{"if (a) { x } else if (b) { y } else { z }",
+			"(if a then { x; } else if b then { y; } else { z; })"},
+		{"if (a) { x } else { if (b) { y } else { z } }",
+			"(if a then { x; } else { (if b then { y; } else { z; }); })"},
+		{"let v = if (a) { 1 } else if (b) { 2 } else { 3 };",
+			"let v = (if a then { 1; } else if b then { 2; } else { 3; });"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, 1)
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+
+	for _, input := range []string{"if (a) { x } else if { y }", "if (a) { x } else if (b) y", "if (a) { x } else"} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected errors for %q, got none", input)
+		}
+	}
+}
+
+func TestWhileStatement(t *testing.T) {
+	program := initParser(t, "while (x < y) { x; break; continue; }", 1)
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("statement is not ast.WhileStatement. Got %T", program.Statements[0])
+	}
+	if !testInfixExpression(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+	if len(stmt.Body.Statements) != 3 {
+		t.Fatalf("body has wrong number of statements. Got %d", len(stmt.Body.Statements))
+	}
+	if _, ok := stmt.Body.Statements[1].(*ast.BreakStatement); !ok {
+		t.Errorf("statement 1 is not ast.BreakStatement. Got %T", stmt.Body.Statements[1])
+	}
+	if _, ok := stmt.Body.Statements[2].(*ast.ContinueStatement); !ok {
+		t.Errorf("statement 2 is not ast.ContinueStatement. Got %T", stmt.Body.Statements[2])
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	program := initParser(t, "for (let i = 0; i < n; f(i)) { g(i) }", 1)
+	stmt, ok := program.Statements[0].(*ast.ForStatement)
+	if !ok {
+		t.Fatalf("statement is not ast.ForStatement. Got %T", program.Statements[0])
+	}
+	if !testLetStatement(t, stmt.Init, "i") {
+		return
+	}
+	if !testInfixExpression(t, stmt.Condition, "i", "<", "n") {
+		return
+	}
+	if stmt.Post == nil || stmt.Post.String() != "f(i)" {
+		t.Errorf("stmt.Post wrong. Got %v", stmt.Post)
+	}
+	if stmt.Body.String() != "{ g(i); }" {
+		t.Errorf("stmt.Body wrong. Got %q", stmt.Body.String())
+	}
+
+	tests := []struct {
+		input         string
+		numStatements int
+		expected      string
+	}{
+		{"for (;;) { break }", 1, "for (; ; ) { break;; }"},
+		{"for (i; i < 3;) {}", 1, "for (i; (i<3); ) { }"},
+		{"for (; ; i) {}", 1, "for (; ; i) { }"},
+		{"for (let i = 0; i < 3; f(i)) { if (i) { continue } }; x", 2,
+			"for (let i = 0; (i<3); f(i)) { (if i then { continue;; }); }x"},
+		{"while (true) { for (;;) { break } break }", 1,
+			"while true { for (; ; ) { break;; }; break;; }"},
+		{"{ while (x) {} }", 1, "{ while x { }; }"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, tt.numStatements)
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"break", []string{"1:1: 'break' is not inside a loop"}},
+		{"if (x) { continue; }", []string{"1:10: 'continue' is not inside a loop"}},
+		{"while (x) { fn() { break } }", []string{"1:20: 'break' is not inside a loop"}},
+		{"while (x) { let f = fn() { while (y) { break } }; continue }", []string{}},
+		{"for (;;) { break } break", []string{"1:20: 'break' is not inside a loop"}},
+		{"for (; ; fn() { continue }) {}", []string{"1:17: 'continue' is not inside a loop"}},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		if !reflect.DeepEqual(p.Errors(), tt.expected) {
+			t.Errorf("for %q expected errors %q, got %q", tt.input, tt.expected, p.Errors())
+		}
+	}
+
+	p := New(lexer.New("\n  break"))
+	p.ParseProgram()
+	d := p.Diagnostics()[0]
+	if d.Code != ErrOutsideLoop || d.Span.Start.Line != 2 || d.Span.Start.Column != 3 {
+		t.Errorf("diagnostic wrong. Got %+v", d)
+	}
+}
+
+func TestAssignExpressionParsing(t *testing.T) {
+	program := initParser(t, "x += 5 * y;", 1)
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.AssignExpression)
+	if !ok {
+		t.Fatalf("expression is not ast.AssignExpression. Got %T", stmt.Expression)
+	}
+	if !testIdentifier(t, exp.Target, "x") {
+		return
+	}
+	if exp.Operator != "+=" {
+		t.Errorf("exp.Operator is not '+='. Got %q", exp.Operator)
+	}
+	testInfixExpression(t, exp.Value, 5, "*", "y")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 1", "(x = 1)"},
+		{"x = y = z", "(x = (y = z))"},
+		{"x += y -= 2", "(x += (y -= 2))"},
+		{"x = a || b && c", "(x = (a||(b&&c)))"},
+		{"x = y == z", "(x = (y==z))"},
+		{"xs[i + 1] *= 2", "((xs[(i+1)]) *= 2)"},
+		{`h["a"]["b"] /= 4`, `(((h["a"])["b"]) /= 4)`},
+		{"x = fn(a) { a = a + 1 }", "(x = fn(a) { (a = (a+1)); })"},
+		{"f(x = 1)", "f((x = 1))"},
+		{"let y = x = 3;", "let y = (x = 3);"},
+		{"for (let i = 0; i < 3; i = i + 1) { }", "for (let i = 0; (i<3); (i = (i+1))) { }"},
+		{"while (x) { x -= 1 }", "while x { (x -= 1); }"},
+	}
+
+	for _, tt := range tests {
+		program := initParser(t, tt.input, 1)
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestInvalidAssignTargets(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 = 2", "1:3: Cannot assign to 1, only to a name or an index expression"},
+		{"a + b = c", "1:7: Cannot assign to (a+b), only to a name or an index expression"},
+		{"f() += 1", "1:5: Cannot assign to f(), only to a name or an index expression"},
+		{`"s" = x`, "1:5: Cannot assign to \"s\", only to a name or an index expression"},
+		{"(x) = 1", ""},
+		{"-x = 1", "1:4: Cannot assign to (-x), only to a name or an index expression"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if tt.expected == "" {
+			if len(errors) != 0 {
+				t.Errorf("expected no errors for %q, got %q", tt.input, errors)
+			}
+			continue
+		}
+		if len(errors) != 1 || errors[0] != tt.expected {
+			t.Errorf("for %q expected error %q, got %q", tt.input, tt.expected, errors)
+			continue
+		}
+		if p.Diagnostics()[0].Code != ErrInvalidTarget {
+			t.Errorf("wrong code for %q. Got %s", tt.input, p.Diagnostics()[0].Code)
+		}
+	}
+}
+
+func TestNodeSpans(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string // the source text of each node, in Walk order
+	}{
+		{"(a + b) * c;", []string{
+			"(a + b) * c", "(a + b) * c", "(a + b) * c", "(a + b)", "a + b", "a", "b", "c",
+		}},
+		{"let s = \"moo\\n\";", []string{
+			"let s = \"moo\\n\"", "let s = \"moo\\n\"", "s", "\"moo\\n\"",
+		}},
+		{" f((x), [1, 2][0]) ", []string{
+			"f((x), [1, 2][0])", "f((x), [1, 2][0])", "f((x), [1, 2][0])", "f",
+			"(x)", "x", "[1, 2][0]", "[1, 2]", "1", "2", "0",
+		}},
+		{"if (x) { y } else { -z }", []string{
+			"if (x) { y } else { -z }", "if (x) { y } else { -z }",
+			"if (x) { y } else { -z }", "x", "{ y }", "y", "y", "{ -z }", "-z", "-z", "z",
+		}},
+		{"while (i) { i -= 1; break; }", []string{
+			"while (i) { i -= 1; break; }", "while (i) { i -= 1; break; }", "i",
+			"{ i -= 1; break; }", "i -= 1", "i -= 1", "i", "1", "break",
+		}},
+		{"return fn(a) { {a: 1} };", []string{
+			"return fn(a) { {a: 1} }", "return fn(a) { {a: 1} }", "fn(a) { {a: 1} }",
+			"a", "{ {a: 1} }", "{a: 1}", "{a: 1}", "a", "1",
+		}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		spans := []string{}
+		ast.Inspect(program, func(n ast.Node) bool {
+			if n != nil {
+				spans = append(spans, tt.input[n.Pos():n.End()])
+			}
+			return true
+		})
+		if !reflect.DeepEqual(spans, tt.expected) {
+			t.Errorf("Spans of %q wrong. Expected %q, got %q", tt.input, tt.expected, spans)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	inputs := []string{
+		"let x = (1 + 2.5) * -y; return x;",
+		"let f = fn(a, b) { if (a) { b } else if (!b) { {} } else { [a, \"\\n\"][0] } }; f(1, 2);",
+		"{\"k\": true, 1: {}}; { let h = 1; h += 2; }",
+		"for (let i = 0; i < 3; i = i + 1) { while (true) { break; } continue; }",
+		"for (;;) {}",
+		"// comment\nlet y = x; /* more */",
+	}
+
+	for _, input := range inputs {
+		for _, opts := range [][]lexer.Option{nil, {lexer.WithTrivia()}} {
+			l := lexer.NewWithFilename("moo.mc", input, opts...)
+			p := New(l)
+			program := p.ParseProgram()
+			checkParserErrors(t, p)
+
+			data, err := json.Marshal(program)
+			if err != nil {
+				t.Fatalf("Marshalling %q failed: %s", input, err)
+			}
+			decoded, err := ast.UnmarshalJSON(data)
+			if err != nil {
+				t.Fatalf("Unmarshalling %q failed: %s", input, err)
+			}
+			if !reflect.DeepEqual(decoded, program) {
+				t.Errorf("JSON for %q didn't decode to the same tree:\n%s", input, data)
+			}
+		}
+	}
+}
+
+func FuzzJSONRoundTrip(f *testing.F) {
+	seeds := []string{
+		"let x = (1 + 2.5) * -y; return x;",
+		"let f = fn(a, b) { if (a) { b } else { [a, \"\\n\"][0] } }; f(1, 2);",
+		"{\"k\": true, 1: {}}; for (;;) { break; }",
+		"// comment\nlet y = x; /* more */",
+		"a\xceb",
+		"let s = \"\xff\"; s",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		p := New(lexer.New(input, lexer.WithTrivia()))
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			return
+		}
+		data, err := json.Marshal(program)
+		if err != nil {
+			t.Fatalf("Marshalling %q failed: %s", input, err)
+		}
+		decoded, err := ast.UnmarshalJSON(data)
+		if err != nil {
+			t.Fatalf("Unmarshalling %q failed: %s", input, err)
+		}
+		if !ast.Equal(decoded, program) {
+			t.Errorf("JSON for %q didn't decode to the same tree:\n%s", input, data)
+		}
+	})
+}
+
+func TestEqualHashAndCloneOfParsedCode(t *testing.T) {
+	parse := func(input string) *ast.Program {
+		p := New(lexer.New(input, lexer.WithTrivia()))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		return program
+	}
+
+	original := parse("let f = fn(x) { x * (2 + y) }; f(1);")
+	relaidOut := parse("let f = fn(x) {\n\t// double it\n\tx * ( 2 + y )\n};\n\nf( 1 );\n")
+	changed := parse("let f = fn(x) { x * (2 + z) }; f(1);")
+
+	if ast.Equal(original, relaidOut) {
+		t.Errorf("Expected a difference in layout to be seen")
+	}
+	if !ast.Equal(original, relaidOut, ast.IgnorePositions()) {
+		t.Errorf("Expected only a difference in layout")
+	}
+	if ast.Hash(original) != ast.Hash(relaidOut) {
+		t.Errorf("Expected the same hash despite the layout")
+	}
+	if ast.Equal(original, changed, ast.IgnorePositions()) || ast.Hash(original) == ast.Hash(changed) {
+		t.Errorf("Expected y and z to make a difference")
+	}
+
+	clone := ast.Clone(original).(*ast.Program)
+	if !ast.Equal(clone, original) {
+		t.Fatalf("Expected the clone to be the same as the original")
+	}
+	ast.Apply(clone, func(c *ast.Cursor) bool {
+		if ident, ok := c.Node().(*ast.Identifier); ok && ident.Value == "y" {
+			z := ident.Token
+			z.Literal = "z"
+			c.Replace(&ast.Identifier{Token: z, Value: "z"})
+		}
+		return true
+	}, nil)
+	if original.String() != "let f = fn(x) { (x*(2+y)); };f(1)" {
+		t.Errorf("Expected the original untouched, got %q", original.String())
+	}
+	if !ast.Equal(clone, changed, ast.IgnorePositions()) {
+		t.Errorf("Expected the edited clone to match, got %q", clone.String())
+	}
+}
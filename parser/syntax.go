@@ -0,0 +1,70 @@
+package parser
+
+import (
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/token"
+	"reflect"
+)
+
+/*
+A SyntaxBuilder is told about every token the parser reads, in source order
+and exactly once each, and about the nodes they group into, so that it can
+build a concrete syntax tree alongside the AST. A node is reported once it has
+been parsed, by wrapping everything from a mark up to the latest token.
+*/
+type SyntaxBuilder interface {
+	Token(tok token.Token)      // tok has just become the current token
+	Mark() int                  // a position just before the current token
+	Wrap(mark int, kind string) // group everything from mark on into one node
+}
+
+/* WithSyntaxBuilder reports the parse to b, as well as building the AST */
+func WithSyntaxBuilder(b SyntaxBuilder) Option {
+	return func(p *Parser) {
+		p.builder = b
+	}
+}
+
+/*
+Syntax node kinds are the names of the ast types they correspond to, plus
+ErrorKind for whatever a failed parse function read.
+*/
+const ErrorKind = "Error"
+
+/* record passes each token on to the builder, including EOF just the once */
+func (p *Parser) record(tok token.Token) {
+	if p.builder == nil || tok.Type == "" || p.recordedEOF {
+		return
+	}
+	p.recordedEOF = tok.Type == token.EOF
+	p.builder.Token(tok)
+}
+
+func (p *Parser) mark() int {
+	if p.builder == nil {
+		return 0
+	}
+	return p.builder.Mark()
+}
+
+/* wrap reports node as parsed, and as an error if it's nil */
+func (p *Parser) wrap(mark int, node ast.Node) {
+	if p.builder == nil {
+		return
+	}
+	p.builder.Wrap(mark, nodeKind(node))
+}
+
+func (p *Parser) wrapKind(mark int, kind string) {
+	if p.builder != nil {
+		p.builder.Wrap(mark, kind)
+	}
+}
+
+func nodeKind(node ast.Node) string {
+	/* Catch typed nils too, such as a failed *ast.BlockStatement */
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return ErrorKind
+	}
+	return reflect.TypeOf(node).Elem().Name()
+}
@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"fmt"
+	"github.com/cowlet/moncow/ast"
+	"io"
+	"strings"
+)
+
+type Option func(*Parser)
+
+/*
+WithTrace writes an indented trace of the parse to w: every statement, every
+prefix and infix function entered, each precedence comparison, and the node
+that comes back out.
+*/
+func WithTrace(w io.Writer) Option {
+	return func(p *Parser) {
+		p.tracer = w
+	}
+}
+
+var precedenceNames = map[int]string{
+	LOWEST:      "LOWEST",
+	ASSIGN:      "ASSIGN",
+	LOGICAL_OR:  "LOGICAL_OR",
+	LOGICAL_AND: "LOGICAL_AND",
+	EQUALS:      "EQUALS",
+	LESSGREATER: "LESSGREATER",
+	SUM:         "SUM",
+	PRODUCT:     "PRODUCT",
+	PREFIX:      "PREFIX",
+	EXPONENT:    "EXPONENT",
+	CALL:        "CALL",
+	INDEX:       "INDEX",
+}
+
+func precedenceName(precedence int) string {
+	if name, ok := precedenceNames[precedence]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", precedence)
+}
+
+func (p *Parser) tracef(format string, a ...interface{}) {
+	if p.tracer == nil {
+		return
+	}
+	indent := strings.Repeat("  ", p.traceDepth)
+	fmt.Fprintf(p.tracer, indent+format+"\n", a...)
+}
+
+/* trace prints a line, then indents everything up to the matching untrace */
+func (p *Parser) trace(format string, a ...interface{}) {
+	if p.tracer == nil {
+		return
+	}
+	p.tracef(format, a...)
+	p.traceDepth += 1
+}
+
+/*
+untrace ends a trace with the node that came back. Writing the node out takes
+time in its size, so it's only done when tracing, or parsing a long expression
+would take time in the cube of its length.
+*/
+func (p *Parser) untrace(node ast.Node) {
+	if p.tracer == nil {
+		return
+	}
+	p.traceDepth -= 1
+	if node == nil {
+		p.tracef("=> nil")
+	} else {
+		p.tracef("=> %T %s", node, node.String())
+	}
+}
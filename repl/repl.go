@@ -3,8 +3,11 @@ package repl
 import (
 	"bufio"
 	"fmt"
+	"github.com/cowlet/moncow/diagnostic"
+	"github.com/cowlet/moncow/evaluator"
 	"github.com/cowlet/moncow/lexer"
-	"github.com/cowlet/moncow/token"
+	"github.com/cowlet/moncow/object"
+	"github.com/cowlet/moncow/parser"
 	"io"
 )
 
@@ -12,17 +15,33 @@ const PROMPT = ">> "
 
 func Start(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
+	env := object.NewEnvironment()
+
 	for {
-		fmt.Printf(PROMPT)
+		fmt.Fprint(out, PROMPT)
 		scanned := scanner.Scan()
 		if !scanned {
 			return
 		}
 		line := scanner.Text()
-		l := lexer.New(line)
+		l := lexer.NewWithFilename("repl", line)
+		p := parser.New(l)
+
+		program := p.ParseProgram()
+		if len(p.Diagnostics()) != 0 {
+			printParserErrors(out, line, p.Diagnostics())
+			continue
+		}
 
-		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
-			fmt.Printf("%+v\n", tok)
+		evaluated := evaluator.Eval(program, env)
+		if evaluated != nil {
+			fmt.Fprintln(out, evaluated.Inspect())
 		}
 	}
 }
+
+func printParserErrors(out io.Writer, source string, diags []diagnostic.Diagnostic) {
+	for _, d := range diags {
+		fmt.Fprint(out, d.Render(source))
+	}
+}
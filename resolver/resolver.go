@@ -0,0 +1,279 @@
+package resolver
+
+import (
+	"fmt"
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/diagnostic"
+	"sort"
+)
+
+/* Error codes are stable, so tools can match on them */
+const (
+	ErrUndefinedName        diagnostic.Code = "R0001"
+	ErrUsedBeforeDefinition diagnostic.Code = "R0002"
+	WarnShadowing           diagnostic.Code = "R0003"
+)
+
+/*
+A Scope is where names declared with let, or as parameters, can be seen. The
+program and every function has one, as they're what the evaluator gives an
+environment of their own. A let in a block or a for loop's header declares
+its name in the scope around it.
+*/
+type Scope struct {
+	Node  ast.Node // *ast.Program or *ast.FunctionLiteral
+	Outer *Scope   // nil for the program's
+	Inner []*Scope
+	Decls []*Declaration // in the order they're defined
+
+	deferred []*ast.FunctionLiteral // bodies to resolve once the scope is complete
+}
+
+/*
+Lookup finds the declaration a name refers to from within the scope, or nil.
+Within a scope, a name refers to its latest declaration.
+*/
+func (s *Scope) Lookup(name string) *Declaration {
+	for scope := s; scope != nil; scope = scope.Outer {
+		if decl := scope.lookupLocal(name); decl != nil {
+			return decl
+		}
+	}
+	return nil
+}
+
+/* lookup is Lookup, but allows for the program's scope having no outer one */
+func (s *Scope) lookup(name string) *Declaration {
+	if s == nil {
+		return nil
+	}
+	return s.Lookup(name)
+}
+
+/* lookupLocal looks in s alone, at names the resolver has got past */
+func (s *Scope) lookupLocal(name string) *Declaration {
+	for i := len(s.Decls) - 1; i >= 0; i-- {
+		if decl := s.Decls[i]; decl.defined && decl.Name.Value == name {
+			return decl
+		}
+	}
+	return nil
+}
+
+/* A Declaration is a name given by a let statement or a function parameter */
+type Declaration struct {
+	Name  *ast.Identifier
+	Node  ast.Node // the *ast.LetStatement, or *ast.FunctionLiteral for a parameter
+	Scope *Scope
+	Uses  []*ast.Identifier // in the order they were resolved
+
+	defined bool // the resolver has got past it
+}
+
+/* Info is what Resolve finds out about a program */
+type Info struct {
+	Scopes      map[ast.Node]*Scope              // keyed by the node that has the scope
+	Defs        map[*ast.Identifier]*Declaration // the name in every declaration
+	Uses        map[*ast.Identifier]*Declaration // every other identifier that resolved
+	Diagnostics []diagnostic.Diagnostic
+}
+
+/*
+Resolve links every identifier in program to the declaration it refers to.
+Names are scoped to the function they're declared in, from the end of their
+let statement on, so `let x = x + 1;` refers to an earlier x. A function body can
+use names declared after the function in the scopes around it, as it only
+runs when it's called, which allows recursion. A let in a branch or loop body
+counts as defined from there on, though it's only set if that code runs.
+*/
+func Resolve(program *ast.Program) *Info {
+	r := &resolver{info: &Info{
+		Scopes: map[ast.Node]*Scope{},
+		Defs:   map[*ast.Identifier]*Declaration{},
+		Uses:   map[*ast.Identifier]*Declaration{},
+	}}
+	r.openScope(program)
+	r.declareUpfront(program.Statements)
+	r.walkStatements(program.Statements)
+	r.closeScope()
+
+	/* Function bodies are resolved late, so put their diagnostics in place */
+	sort.SliceStable(r.info.Diagnostics, func(i, j int) bool {
+		return r.info.Diagnostics[i].Span.Start.Offset < r.info.Diagnostics[j].Span.Start.Offset
+	})
+	return r.info
+}
+
+type resolver struct {
+	info  *Info
+	scope *Scope
+}
+
+func (r *resolver) openScope(node ast.Node) {
+	scope := &Scope{Node: node, Outer: r.scope}
+	if r.scope != nil {
+		r.scope.Inner = append(r.scope.Inner, scope)
+	}
+	r.info.Scopes[node] = scope
+	r.scope = scope
+}
+
+/*
+declareUpfront adds the names that a scope's statements will define, however
+deeply nested in blocks, so that uses before their definition can be told
+apart from undefined names. A let is added after any in its value, as that's
+the order they're defined in.
+*/
+func (r *resolver) declareUpfront(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			r.declareLets(stmt)
+		}
+	}
+}
+
+func (r *resolver) declareLets(node ast.Node) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FunctionLiteral:
+			return false // declared in the function's own scope
+		case *ast.LetStatement:
+			if n.Value != nil {
+				r.declareLets(n.Value)
+			}
+			if n.Name != nil {
+				r.addDeclaration(n.Name, n)
+			}
+			return false
+		}
+		return true
+	})
+}
+
+func (r *resolver) addDeclaration(name *ast.Identifier, node ast.Node) *Declaration {
+	decl := &Declaration{Name: name, Node: node, Scope: r.scope}
+	r.scope.Decls = append(r.scope.Decls, decl)
+	r.info.Defs[name] = decl
+	return decl
+}
+
+/* closeScope resolves the function bodies left until the scope was complete */
+func (r *resolver) closeScope() {
+	for i := 0; i < len(r.scope.deferred); i++ {
+		r.walkFunction(r.scope.deferred[i])
+	}
+	r.scope = r.scope.Outer
+}
+
+func (r *resolver) walkStatements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			ast.Walk(r, stmt)
+		}
+	}
+}
+
+/* Visit takes over the walk at each node that declares or uses a name */
+func (r *resolver) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.LetStatement:
+		if n.Value != nil {
+			ast.Walk(r, n.Value)
+		}
+		if n.Name != nil {
+			r.define(r.info.Defs[n.Name])
+		}
+		return nil
+
+	case *ast.ForStatement:
+		r.walkFor(n)
+		return nil
+
+	case *ast.FunctionLiteral:
+		r.scope.deferred = append(r.scope.deferred, n)
+		return nil
+
+	case *ast.Identifier:
+		r.use(n)
+		return nil
+	}
+	return r
+}
+
+/* walkFor goes through a for loop in the order it runs, so its post can use names from its body */
+func (r *resolver) walkFor(fs *ast.ForStatement) {
+	if fs.Init != nil {
+		ast.Walk(r, fs.Init)
+	}
+	if fs.Condition != nil {
+		ast.Walk(r, fs.Condition)
+	}
+	if fs.Body != nil {
+		ast.Walk(r, fs.Body)
+	}
+	if fs.Post != nil {
+		ast.Walk(r, fs.Post)
+	}
+}
+
+/* walkFunction resolves a function's body, in a scope with its parameters */
+func (r *resolver) walkFunction(fl *ast.FunctionLiteral) {
+	var stmts []ast.Statement
+	if fl.Body != nil {
+		stmts = fl.Body.Statements
+	}
+	r.openScope(fl)
+	for _, param := range fl.Parameters {
+		r.define(r.addDeclaration(param, fl))
+	}
+	r.declareUpfront(stmts)
+	r.walkStatements(stmts)
+	r.closeScope()
+}
+
+/* define makes a declaration visible, warning if it hides an outer one */
+func (r *resolver) define(decl *Declaration) {
+	if outer := decl.Scope.Outer.lookup(decl.Name.Value); outer != nil {
+		d := diagnostic.Errorf(WarnShadowing, diagnostic.TokenSpan(decl.Name.Token),
+			"'%s' shadows an outer declaration", decl.Name.Value)
+		d.Severity = diagnostic.Warning
+		d.Notes = []string{fmt.Sprintf("The outer '%s' is declared at %s",
+			outer.Name.Value, outer.Name.Token.Pos)}
+		r.report(d)
+	}
+	decl.defined = true
+}
+
+func (r *resolver) use(ident *ast.Identifier) {
+	decl := r.scope.Lookup(ident.Value)
+	if decl == nil {
+		decl = r.upcoming(ident.Value)
+		if decl == nil {
+			r.report(diagnostic.Errorf(ErrUndefinedName, diagnostic.TokenSpan(ident.Token),
+				"'%s' is not defined", ident.Value))
+			return
+		}
+		d := diagnostic.Errorf(ErrUsedBeforeDefinition, diagnostic.TokenSpan(ident.Token),
+			"'%s' is used before it's defined", ident.Value)
+		d.Notes = []string{fmt.Sprintf("'%s' is defined at %s", decl.Name.Value, decl.Name.Token.Pos)}
+		r.report(d)
+	}
+	decl.Uses = append(decl.Uses, ident)
+	r.info.Uses[ident] = decl
+}
+
+/* upcoming finds the first declaration of a name still to come */
+func (r *resolver) upcoming(name string) *Declaration {
+	for scope := r.scope; scope != nil; scope = scope.Outer {
+		for _, decl := range scope.Decls {
+			if !decl.defined && decl.Name.Value == name {
+				return decl
+			}
+		}
+	}
+	return nil
+}
+
+func (r *resolver) report(d diagnostic.Diagnostic) {
+	r.info.Diagnostics = append(r.info.Diagnostics, d)
+}
@@ -0,0 +1,215 @@
+package resolver
+
+import (
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/diagnostic"
+	"github.com/cowlet/moncow/evaluator"
+	"github.com/cowlet/moncow/lexer"
+	"github.com/cowlet/moncow/object"
+	"github.com/cowlet/moncow/parser"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func resolve(t *testing.T, input string) (*ast.Program, *Info) {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("Parser errors for %q: %v", input, p.Errors())
+	}
+	return program, Resolve(program)
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"let x = 1; x;", []string{}},
+		{"y;", []string{"1:1: 'y' is not defined"}},
+		{"x; let x = 1;", []string{"1:1: 'x' is used before it's defined"}},
+		{"let x = x + 1;", []string{"1:9: 'x' is used before it's defined"}},
+		/* Blocks don't have scopes, so a let in one is in the function around it */
+		{"let x = 1; { let x = x + 1; }", []string{}},
+		{"let x = 1; let f = fn() { let x = x + 1; };", []string{"1:31: 'x' shadows an outer declaration"}},
+		{"let x = 1; let f = fn(x) { x };", []string{"1:23: 'x' shadows an outer declaration"}},
+		{"{ let y = 1; } y;", []string{}},
+		{"y; if (true) { let y = 1; }", []string{"1:1: 'y' is used before it's defined"}},
+		{"let f = fn() { let y = 1; }; y;", []string{"1:30: 'y' is not defined"}},
+		{"z = 1; let a = [1]; a[0] = b;", []string{
+			"1:1: 'z' is not defined", "1:28: 'b' is not defined",
+		}},
+		/* Function bodies run later, so can use names declared after them */
+		{"let f = fn(n) { if (n) { f(n - 1) } else { g() } }; let g = fn() { f(0) };", []string{}},
+		{"let f = fn() { h }; g; let g = 1;", []string{
+			"1:16: 'h' is not defined", "1:21: 'g' is used before it's defined",
+		}},
+		{"for (let i = 0; i < 3; i += 1) { let j = i; } i; j;", []string{}},
+		{"for (let i = 0; i < 3; i += j) { let j = i; }", []string{}},
+		{"let h = {k: 1}; let k = 2;", []string{"1:10: 'k' is used before it's defined"}},
+	}
+
+	for _, tt := range tests {
+		_, info := resolve(t, tt.input)
+		got := []string{}
+		for _, d := range info.Diagnostics {
+			got = append(got, d.String())
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("Diagnostics for %q wrong. Expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestBindings(t *testing.T) {
+	/* Each use, by its offset, and the offset of the name it refers to */
+	tests := []struct {
+		input    string
+		expected map[int]int
+	}{
+		{"let x = 1; let y = x;", map[int]int{19: 4}},
+		{"let x = 1; let x = x + 1; x;", map[int]int{19: 4, 26: 15}},
+		{"let x = 1; { let x = 2; x; } x;", map[int]int{24: 17, 29: 17}},
+		{"let x = 1; let x = if (x) { let x = 2; x } else { 3 }; x;", map[int]int{23: 4, 39: 32, 55: 15}},
+		{"let f = fn(a, b) { a + f(b) };", map[int]int{19: 11, 23: 4, 25: 14}},
+		{"for (let i = 0; i < 1; i += 1) { i; }", map[int]int{16: 9, 23: 9, 33: 9}},
+	}
+
+	for _, tt := range tests {
+		program, info := resolve(t, tt.input)
+		for _, d := range info.Diagnostics {
+			if d.Severity == diagnostic.Error {
+				t.Fatalf("Unexpected error for %q: %s", tt.input, d)
+			}
+		}
+		got := map[int]int{}
+		for use, decl := range info.Uses {
+			got[use.Pos()] = decl.Name.Pos()
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("Bindings for %q wrong. Expected %v, got %v", tt.input, tt.expected, got)
+		}
+
+		/* Every identifier is either a declaration or a use */
+		ast.Inspect(program, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Identifier); ok {
+				if (info.Defs[ident] == nil) == (info.Uses[ident] == nil) {
+					t.Errorf("%q: %s at %d isn't exactly one of a declaration and a use",
+						tt.input, ident.Value, ident.Pos())
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestScopes(t *testing.T) {
+	program, info := resolve(t, "let a = 1; let f = fn(b) { let c = { d: 1 }; while (c) { let e = b; } };")
+
+	top := info.Scopes[program]
+	if top == nil || top.Outer != nil {
+		t.Fatalf("Expected the program's scope to be outermost")
+	}
+	names := func(s *Scope) []string {
+		names := []string{}
+		for _, decl := range s.Decls {
+			names = append(names, decl.Name.Value)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if got := names(top); !reflect.DeepEqual(got, []string{"a", "f"}) {
+		t.Errorf("Expected a and f in the program's scope, got %v", got)
+	}
+	if len(top.Inner) != 1 {
+		t.Fatalf("Expected one scope inside the program's, got %d", len(top.Inner))
+	}
+	fn := top.Inner[0]
+	if _, ok := fn.Node.(*ast.FunctionLiteral); !ok {
+		t.Fatalf("Expected the function's scope, got %T", fn.Node)
+	}
+	/* The while body's let is in the function's scope, as it has none of its own */
+	if got := names(fn); !reflect.DeepEqual(got, []string{"b", "c", "e"}) {
+		t.Errorf("Expected b, c and e in the function's scope, got %v", got)
+	}
+	if len(fn.Inner) != 0 {
+		t.Fatalf("Expected no scopes inside the function's, got %d", len(fn.Inner))
+	}
+
+	if fn.Lookup("a") != top.Decls[0] || fn.Lookup("e") != fn.Decls[2] {
+		t.Errorf("Expected lookups from the function to find a and e")
+	}
+	if fn.Lookup("d") != nil {
+		t.Errorf("Expected d not to be found, as it's a hash key that's never declared")
+	}
+	if len(info.Diagnostics) != 1 || info.Diagnostics[0].Code != ErrUndefinedName {
+		t.Errorf("Expected only d to be reported, got %v", info.Diagnostics)
+	}
+}
+
+/*
+The resolver's scopes must be the evaluator's. Each program ends with a name,
+which should either be reported, and not found when run, or resolve to a let
+of the value it evaluates to.
+*/
+func TestAgreesWithEvaluator(t *testing.T) {
+	inputs := []string{
+		"let x = 1; x",
+		"let x = 1; { let x = 2; } x",
+		"let x = 1; { let x = 2; x }",
+		"let x = 1; if (true) { let x = 5; } x",
+		"let x = 1; let f = fn() { let x = 3; x }; f(); x",
+		"let f = fn() { let x = 3; { let x = 4; } x }; f()",
+		"{ let y = 1; } y",
+		"if (true) { let z = 5; } z",
+		"let x = 1; for (let i = 0; i < 1; i += 1) { let x = 8; } x",
+		"let n = 2; while (n > 0) { let m = 4; n -= 1; } m",
+		"let x = 1; let f = fn() { if (true) { let x = 2; } x }; f()",
+		"let g = fn() { h }; let h = 6; g()",
+		"h; let h = 6;",
+	}
+
+	for _, input := range inputs {
+		program, info := resolve(t, input)
+		resolved := true
+		for _, d := range info.Diagnostics {
+			if d.Severity == diagnostic.Error {
+				resolved = false
+			}
+		}
+
+		result := evaluator.Eval(program, object.NewEnvironment())
+		if err, ok := result.(*object.Error); ok {
+			if resolved || !strings.HasPrefix(err.Message, "Identifier not found") {
+				t.Errorf("%q: the resolver found no error, but evaluating it gave %s", input, err.Message)
+			}
+			continue
+		}
+		if !resolved {
+			t.Errorf("%q: the resolver reported %v, but it evaluates to %s", input, info.Diagnostics, result.Inspect())
+			continue
+		}
+
+		/* Find the let the last name refers to, following function calls */
+		var last *ast.Identifier
+		ast.Inspect(program.Statements[len(program.Statements)-1], func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Identifier); ok {
+				last = ident
+			}
+			return true
+		})
+		decl := info.Uses[last]
+		if fn, ok := decl.Node.(*ast.LetStatement).Value.(*ast.FunctionLiteral); ok {
+			stmts := fn.Body.Statements
+			last = stmts[len(stmts)-1].(*ast.ExpressionStatement).Expression.(*ast.Identifier)
+			decl = info.Uses[last]
+		}
+		if value := decl.Node.(*ast.LetStatement).Value.String(); value != result.Inspect() {
+			t.Errorf("%q: the last name resolves to a let of %s, but it evaluates to %s",
+				input, value, result.Inspect())
+		}
+	}
+}
@@ -1,10 +1,49 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
-	Type    TokenType
-	Literal string
+	Type    TokenType `json:"type"`
+	Literal string    `json:"literal"`
+	Pos     Position  `json:"pos"` // where the token starts in the source
+	End     Position  `json:"end"` // just past the token's last character
+
+	/* Only filled in when the lexer is asked to preserve trivia */
+	Leading  []Trivia `json:"leading,omitempty"`  // from the previous token's trailing trivia up to this one
+	Trailing []Trivia `json:"trailing,omitempty"` // after this token, up to the end of its line
+}
+
+type TriviaKind string
+
+const (
+	WHITESPACE    TriviaKind = "WHITESPACE"
+	LINE_COMMENT  TriviaKind = "LINE_COMMENT"  // through to the end of the line
+	BLOCK_COMMENT TriviaKind = "BLOCK_COMMENT" /* which may nest */
+)
+
+/* Trivia is source text between tokens that doesn't affect the parse */
+type Trivia struct {
+	Kind TriviaKind `json:"kind"`
+	Text string     `json:"text"` // exactly as in the source, including comment markers
+	Pos  Position   `json:"pos"`
+}
+
+type Position struct {
+	Filename string `json:"filename,omitempty"` // may be empty
+	Offset   int    `json:"offset"`             // byte offset, starting at 0
+	Line     int    `json:"line"`               // line number, starting at 1
+	Column   int    `json:"column"`             // column number in runes, starting at 1
+}
+
+/* String returns "file:line:col", or "line:col" if there's no filename */
+func (p Position) String() string {
+	s := fmt.Sprintf("%d:%d", p.Line, p.Column)
+	if p.Filename != "" {
+		s = p.Filename + ":" + s
+	}
+	return s
 }
 
 const (
@@ -12,9 +51,10 @@ const (
 	EOF     = "EOF"
 
 	// Identifiers and literals
-	IDENT = "IDENT" // add, x, y, etc
-	INT   = "INT"   // integers
-	FLOAT = "FLOAT" // floating point numbers
+	IDENT  = "IDENT"  // add, x, y, etc
+	INT    = "INT"    // integers
+	FLOAT  = "FLOAT"  // floating point numbers
+	STRING = "STRING" // "moo"
 
 	// Operators
 	ASSIGN = "="
@@ -22,23 +62,38 @@ const (
 	MINUS  = "-"
 	MULT   = "*"
 	DIV    = "/"
+	MOD    = "%"
+	POW    = "**"
 
 	BANG = "!"
 
-	LT = "<"
-	GT = ">"
+	PLUS_ASSIGN  = "+="
+	MINUS_ASSIGN = "-="
+	MULT_ASSIGN  = "*="
+	DIV_ASSIGN   = "/="
+
+	LT  = "<"
+	GT  = ">"
+	LTE = "<="
+	GTE = ">="
 
 	EQ  = "=="
 	NEQ = "!="
 
+	AND = "&&"
+	OR  = "||"
+
 	// Delimiters
 	COMMA = ","
 	SEMI  = ";"
+	COLON = ":"
 
-	LPAREN = "("
-	RPAREN = ")"
-	LBRACE = "{"
-	RBRACE = "}"
+	LPAREN   = "("
+	RPAREN   = ")"
+	LBRACE   = "{"
+	RBRACE   = "}"
+	LBRACKET = "["
+	RBRACKET = "]"
 
 	// Keywords
 	LET    = "LET"
@@ -48,6 +103,11 @@ const (
 	ELSE   = "ELSE"
 	TRUE   = "TRUE"
 	FALSE  = "FALSE"
+
+	WHILE    = "WHILE"
+	FOR      = "FOR"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
 )
 
 var keywords = map[string]TokenType{
@@ -58,6 +118,11 @@ var keywords = map[string]TokenType{
 	"else":   ELSE,
 	"true":   TRUE,
 	"false":  FALSE,
+
+	"while":    WHILE,
+	"for":      FOR,
+	"break":    BREAK,
+	"continue": CONTINUE,
 }
 
 func LookupIdent(ident string) TokenType {
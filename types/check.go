@@ -0,0 +1,677 @@
+package types
+
+import (
+	"fmt"
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/diagnostic"
+	"github.com/cowlet/moncow/resolver"
+	"github.com/cowlet/moncow/token"
+	"reflect"
+	"strings"
+)
+
+/* Error codes are stable, so tools can match on them */
+const (
+	ErrMismatch      diagnostic.Code = "T0001"
+	ErrOperands      diagnostic.Code = "T0002"
+	ErrArgumentCount diagnostic.Code = "T0003"
+	ErrNotCallable   diagnostic.Code = "T0004"
+	ErrNotIndexable  diagnostic.Code = "T0005"
+)
+
+/* Info is what Check finds out about a program */
+type Info struct {
+	Diagnostics []diagnostic.Diagnostic
+
+	types map[ast.Expression]Type
+}
+
+/*
+TypeOf gives the type of an expression in the checked program, or nil if it
+isn't one. The type of a function declared with let can have vars in it, as
+in fn(a) -> a, when it works for any type.
+*/
+func (info *Info) TypeOf(exp ast.Expression) Type {
+	t, ok := info.types[exp]
+	if !ok {
+		return nil
+	}
+	return resolve(t)
+}
+
+/*
+Check infers the type of every expression in program, with Hindley-Milner
+type inference, and reports where types don't fit together. Functions
+declared with let are polymorphic, so fn(x) { x } can be used on any type,
+unless they're assigned to.
+
+The rules are stricter than the evaluator's. The elements of an array, the
+keys and values of a hash, and the branches of an if must each have one type,
+and an if without an else gives Null. Ints and Floats can be mixed in
+arithmetic, as they can at run time, but only where both are known to be
+numbers where the operator is, not through a function's parameters.
+
+Names are linked to their declarations by the resolver, whose diagnostics
+aren't repeated here.
+*/
+func Check(program *ast.Program) *Info {
+	ch := &checker{
+		info:     &Info{types: map[ast.Expression]Type{}},
+		names:    resolver.Resolve(program),
+		decls:    map[*resolver.Declaration]*scheme{},
+		assigned: map[*resolver.Declaration]bool{},
+	}
+	ast.Inspect(program, func(node ast.Node) bool {
+		if ae, ok := node.(*ast.AssignExpression); ok {
+			if target, ok := ast.Unparen(ae.Target).(*ast.Identifier); ok && ch.names.Uses[target] != nil {
+				ch.assigned[ch.names.Uses[target]] = true
+			}
+		}
+		return true
+	})
+	ch.statements(program.Statements)
+	ch.solvePending()
+	ch.guessPending(func(*Var) bool { return true })
+	return ch.info
+}
+
+/* A scheme is a declaration's type, which is polymorphic in vars */
+type scheme struct {
+	vars []*Var
+	t    Type
+}
+
+/*
+An indexing is an index expression on something whose type isn't known yet,
+which can't be checked until it is, as arrays and hashes index differently
+*/
+type indexing struct {
+	node        *ast.IndexExpression
+	left, index Type
+	result      Type
+}
+
+type checker struct {
+	info     *Info
+	names    *resolver.Info
+	decls    map[*resolver.Declaration]*scheme
+	assigned map[*resolver.Declaration]bool // names that are assigned to somewhere
+	level    int                            // how many lets deep the checker is
+	results  []Type                         // results of the functions being checked, innermost last
+	pending  []*indexing
+}
+
+func (ch *checker) fresh(c class) *Var {
+	return &Var{level: ch.level, class: c}
+}
+
+func (ch *checker) statements(stmts []ast.Statement) Type {
+	var t Type = Null
+	for _, stmt := range stmts {
+		if stmt != nil {
+			t = ch.statement(stmt)
+		}
+	}
+	return t
+}
+
+func (ch *checker) block(bs *ast.BlockStatement) Type {
+	if bs == nil {
+		return Null
+	}
+	return ch.statements(bs.Statements)
+}
+
+/*
+statement gives the type of the value a statement leaves, which a block takes
+from its last one. Statements that jump elsewhere have a fresh var, so they
+fit anywhere.
+*/
+func (ch *checker) statement(stmt ast.Statement) Type {
+	switch s := stmt.(type) {
+	case *ast.LetStatement:
+		return ch.let(s)
+
+	case *ast.ReturnStatement:
+		var t Type = Null
+		if s.Value != nil {
+			t = ch.expression(s.Value)
+		}
+		if n := len(ch.results); n > 0 {
+			ch.unify(s, t, ch.results[n-1], "Mismatched return value")
+		}
+		return ch.fresh(0)
+
+	case *ast.ExpressionStatement:
+		if s.Expression != nil {
+			return ch.expression(s.Expression)
+		}
+
+	case *ast.WhileStatement:
+		ch.expression(s.Condition)
+		ch.block(s.Body)
+
+	case *ast.ForStatement:
+		if s.Init != nil {
+			ch.statement(s.Init)
+		}
+		ch.expression(s.Condition)
+		ch.expression(s.Post)
+		ch.block(s.Body)
+
+	case *ast.BreakStatement, *ast.ContinueStatement:
+		return ch.fresh(0)
+
+	case *ast.BlockStatement:
+		return ch.block(s)
+	}
+	return Null
+}
+
+/*
+let binds a name to its value's type. A function value is checked one level
+deeper, with its own name in scope for recursion, and generalized afterwards,
+unless the name is assigned to somewhere. Every use of a polymorphic name gets
+its own copy of the type, so nothing would make a new value fit them all.
+*/
+func (ch *checker) let(ls *ast.LetStatement) Type {
+	decl := ch.names.Defs[ls.Name]
+	var t Type
+	if fl, ok := ast.Unparen(ls.Value).(*ast.FunctionLiteral); ok && !ch.assigned[decl] {
+		ch.level++
+		self := ch.declare(decl)
+		t = ch.expression(fl)
+		ch.unify(fl, t, self, "Mismatched earlier use")
+		ch.level--
+		ch.generalize(decl, t)
+	} else {
+		t = ch.expression(ls.Value)
+		ch.unify(ls, t, ch.declare(decl), "Mismatched earlier use")
+	}
+	if ls.Name != nil {
+		ch.info.types[ls.Name] = t
+	}
+	return t
+}
+
+/*
+declare gives the type of a declaration about to be checked. It can already
+have one, if a function body used it before its let statement was reached.
+*/
+func (ch *checker) declare(decl *resolver.Declaration) Type {
+	if decl == nil {
+		return ch.fresh(0)
+	}
+	if s, ok := ch.decls[decl]; ok {
+		return s.t
+	}
+	v := ch.fresh(0)
+	ch.decls[decl] = &scheme{t: v}
+	return v
+}
+
+/* generalize makes the vars created inside a let polymorphic in decl's type */
+func (ch *checker) generalize(decl *resolver.Declaration, t Type) {
+	if decl == nil {
+		return
+	}
+	/* Guess at indexes on vars about to be generalized, and keep the rest out */
+	ch.solvePending()
+	ch.guessPending(func(v *Var) bool { return v.level > ch.level })
+	for _, p := range ch.pending {
+		adjustLevels(p.left, ch.level)
+		adjustLevels(p.index, ch.level)
+		adjustLevels(p.result, ch.level)
+	}
+
+	s := &scheme{t: t}
+	seen := map[*Var]bool{}
+	var collect func(t Type)
+	collect = func(t Type) {
+		switch t := prune(t).(type) {
+		case *Var:
+			if t.level > ch.level && !seen[t] {
+				seen[t] = true
+				s.vars = append(s.vars, t)
+			}
+		case *Array:
+			collect(t.Elem)
+		case *Hash:
+			collect(t.Key)
+			collect(t.Value)
+		case *Function:
+			for _, param := range t.Params {
+				collect(param)
+			}
+			collect(t.Result)
+		}
+	}
+	collect(t)
+	ch.decls[decl] = s
+}
+
+/* instantiate copies a scheme's type, with fresh vars for its polymorphic ones */
+func (ch *checker) instantiate(s *scheme) Type {
+	if len(s.vars) == 0 {
+		return s.t
+	}
+	fresh := map[*Var]*Var{}
+	for _, v := range s.vars {
+		fresh[v] = ch.fresh(v.class)
+	}
+	var inst func(t Type) Type
+	inst = func(t Type) Type {
+		switch t := prune(t).(type) {
+		case *Var:
+			if v, ok := fresh[t]; ok {
+				return v
+			}
+		case *Array:
+			return &Array{Elem: inst(t.Elem)}
+		case *Hash:
+			return &Hash{Key: inst(t.Key), Value: inst(t.Value)}
+		case *Function:
+			params := make([]Type, len(t.Params))
+			for i, param := range t.Params {
+				params[i] = inst(param)
+			}
+			return &Function{Params: params, Result: inst(t.Result)}
+		}
+		return t
+	}
+	return inst(s.t)
+}
+
+/* expression infers the type of exp, and records it for TypeOf */
+func (ch *checker) expression(exp ast.Expression) Type {
+	if missing(exp) {
+		return ch.fresh(0)
+	}
+	t := ch.infer(exp)
+	ch.info.types[exp] = t
+	return t
+}
+
+func (ch *checker) infer(exp ast.Expression) Type {
+	switch e := exp.(type) {
+	case *ast.IntegerLiteral:
+		return Int
+	case *ast.FloatLiteral:
+		return Float
+	case *ast.StringLiteral:
+		return String
+	case *ast.Boolean:
+		return Bool
+
+	case *ast.Identifier:
+		decl := ch.names.Uses[e]
+		if decl == nil {
+			return ch.fresh(0) // the resolver reports it
+		}
+		if _, ok := ch.decls[decl]; !ok {
+			/* A function body using a name declared later, so nothing generalizes it */
+			ch.decls[decl] = &scheme{t: &Var{level: 0}}
+		}
+		return ch.instantiate(ch.decls[decl])
+
+	case *ast.PrefixExpression:
+		right := ch.expression(e.Right)
+		if e.Operator == "!" {
+			return Bool
+		}
+		if unify(right, ch.fresh(numeric)) != nil {
+			ch.report(diagnostic.Errorf(ErrOperands, spanOf(e),
+				"Invalid operand to %s: %s", e.Operator, right))
+		}
+		return right
+
+	case *ast.InfixExpression:
+		left := ch.expression(e.Left)
+		right := ch.expression(e.Right)
+		result := ch.operator(e, e.Operator, left, right)
+		/* A negative power of an Int is a Float, so only a literal exponent is known to give an Int */
+		_, literal := ast.Unparen(e.Right).(*ast.IntegerLiteral)
+		if e.Operator == "**" && prune(result) == Int && !literal {
+			return Float
+		}
+		return result
+
+	case *ast.ParenExpression:
+		return ch.expression(e.Expression)
+
+	case *ast.AssignExpression:
+		target := ch.expression(e.Target)
+		value := ch.expression(e.Value)
+		var node ast.Node = e.Value
+		if e.Operator != "=" {
+			value = ch.operator(e, strings.TrimSuffix(e.Operator, "="), target, value)
+			node = e
+		}
+		ch.unify(node, value, target, "Mismatched assignment")
+		return target
+
+	case *ast.IfExpression:
+		ch.expression(e.Condition)
+		then := ch.block(e.IfBlock)
+		var other Type
+		switch el := e.ElseBlock.(type) {
+		case *ast.BlockStatement:
+			other = ch.block(el)
+		case *ast.IfExpression:
+			other = ch.expression(el)
+		default:
+			return Null
+		}
+		ch.unify(e.ElseBlock, other, then, "Mismatched if branches")
+		return then
+
+	case *ast.FunctionLiteral:
+		return ch.function(e)
+
+	case *ast.CallExpression:
+		return ch.call(e)
+
+	case *ast.ArrayLiteral:
+		elem := ch.fresh(0)
+		for _, el := range e.Elements {
+			ch.unify(el, ch.expression(el), elem, "Mismatched array element")
+		}
+		return &Array{Elem: elem}
+
+	case *ast.IndexExpression:
+		left := ch.expression(e.Left)
+		index := ch.expression(e.Index)
+		return ch.index(e, left, index)
+
+	case *ast.HashLiteral:
+		key, value := ch.fresh(hashable), ch.fresh(0)
+		for _, pair := range e.Pairs {
+			ch.unify(pair.Key, ch.expression(pair.Key), key, "Mismatched hash key")
+			ch.unify(pair.Value, ch.expression(pair.Value), value, "Mismatched hash value")
+		}
+		return &Hash{Key: key, Value: value}
+	}
+	return ch.fresh(0)
+}
+
+/*
+operator gives the type of a binary operator's result. Ints and Floats mix
+when both sides are known to be numbers, giving a Float as the evaluator does.
+Otherwise both sides must have the same type, and one the operator works on.
+*/
+func (ch *checker) operator(node ast.Node, op string, left, right Type) Type {
+	var c class
+	switch op {
+	case "&&", "||":
+		return Bool
+	case "==", "!=":
+		c = 0
+	case "+":
+		c = addable
+	default:
+		c = numeric
+	}
+
+	result := left
+	l, r := prune(left), prune(right)
+	if isNumber(l) && isNumber(r) {
+		if l != r {
+			result = Float
+		}
+	} else if unify(l, r) != nil || unify(l, ch.fresh(c)) != nil {
+		strs := typeStrings(l, r)
+		ch.report(diagnostic.Errorf(ErrOperands, spanOf(node),
+			"Invalid operands to %s: %s and %s", op, strs[0], strs[1]))
+		result = ch.fresh(0)
+	}
+
+	switch op {
+	case "==", "!=", "<", ">", "<=", ">=":
+		return Bool
+	}
+	return result
+}
+
+func isNumber(t Type) bool {
+	return t == Int || t == Float
+}
+
+func (ch *checker) function(fl *ast.FunctionLiteral) Type {
+	params := make([]Type, len(fl.Parameters))
+	for i, param := range fl.Parameters {
+		v := ch.fresh(0)
+		params[i] = v
+		if decl := ch.names.Defs[param]; decl != nil {
+			ch.decls[decl] = &scheme{t: v}
+		}
+		ch.info.types[param] = v
+	}
+
+	result := ch.fresh(0)
+	ch.results = append(ch.results, result)
+	body := ch.block(fl.Body)
+	if fl.Body != nil && len(fl.Body.Statements) > 0 {
+		last := fl.Body.Statements[len(fl.Body.Statements)-1]
+		ch.unify(last, body, result, "Mismatched return value")
+	} else {
+		ch.unify(fl, body, result, "Mismatched return value")
+	}
+	ch.results = ch.results[:len(ch.results)-1]
+	return &Function{Params: params, Result: result}
+}
+
+func (ch *checker) call(ce *ast.CallExpression) Type {
+	f := ch.expression(ce.Function)
+	args := make([]Type, len(ce.Arguments))
+	for i, arg := range ce.Arguments {
+		args[i] = ch.expression(arg)
+	}
+
+	switch ft := prune(f).(type) {
+	case *Function:
+		if len(ft.Params) != len(args) {
+			ch.report(diagnostic.Errorf(ErrArgumentCount, spanOf(ce),
+				"Expected %s, got %d", plural(len(ft.Params), "argument"), len(args)))
+			return ft.Result
+		}
+		for i, arg := range args {
+			ch.unify(ce.Arguments[i], arg, ft.Params[i], fmt.Sprintf("Mismatched argument %d", i+1))
+		}
+		return ft.Result
+
+	case *Var:
+		result := ch.fresh(0)
+		ch.unify(ce, &Function{Params: args, Result: result}, ft, "Mismatched call")
+		return result
+	}
+	ch.report(diagnostic.Errorf(ErrNotCallable, spanOf(ce.Function), "%s can't be called", f))
+	return ch.fresh(0)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+/*
+index gives the type of indexing left with index. Arrays take Ints, and hashes
+their key type. If left's type isn't known yet, the check waits until it is.
+*/
+func (ch *checker) index(ie *ast.IndexExpression, left, index Type) Type {
+	switch lt := prune(left).(type) {
+	case *Array:
+		ch.unify(ie.Index, index, Int, "Mismatched index")
+		return lt.Elem
+	case *Hash:
+		ch.unify(ie.Index, index, lt.Key, "Mismatched hash key")
+		return lt.Value
+	case *Var:
+		result := ch.fresh(0)
+		ch.pending = append(ch.pending, &indexing{node: ie, left: left, index: index, result: result})
+		return result
+	}
+	ch.report(diagnostic.Errorf(ErrNotIndexable, spanOf(ie.Left), "%s can't be indexed", left))
+	return ch.fresh(0)
+}
+
+/* solvePending checks the index expressions whose left side is now known */
+func (ch *checker) solvePending() {
+	for progress := true; progress; {
+		progress = false
+		pending := ch.pending
+		ch.pending = nil
+		for _, p := range pending {
+			if _, ok := prune(p.left).(*Var); ok {
+				ch.pending = append(ch.pending, p)
+				continue
+			}
+			progress = true
+			ch.unify(p.node, ch.index(p.node, p.left, p.index), p.result, "Mismatched index")
+		}
+	}
+}
+
+/*
+guessPending settles the index expressions left pending on the vars chosen,
+taking the var to be an array if the index is an Int, or a hash if the index
+has some other known type
+*/
+func (ch *checker) guessPending(choose func(v *Var) bool) {
+	pending := ch.pending
+	ch.pending = nil
+	for _, p := range pending {
+		left, ok := prune(p.left).(*Var)
+		if !ok || !choose(left) {
+			ch.pending = append(ch.pending, p)
+			continue
+		}
+		switch index := prune(p.index); {
+		case index == Int:
+			ch.unify(p.node, p.left, &Array{Elem: p.result}, "Mismatched index")
+		case !isVar(index):
+			ch.unify(p.node, p.left, &Hash{Key: index, Value: p.result}, "Mismatched index")
+		default:
+			ch.pending = append(ch.pending, p)
+		}
+	}
+}
+
+func isVar(t Type) bool {
+	_, ok := t.(*Var)
+	return ok
+}
+
+/*
+unify makes found and expected the same type, reporting where they aren't at
+node, with context saying what was being checked
+*/
+func (ch *checker) unify(node ast.Node, found, expected Type, context string) bool {
+	if err := unify(found, expected); err != nil {
+		ch.report(diagnostic.Errorf(ErrMismatch, spanOf(node), "%s: %s", context, err))
+		return false
+	}
+	return true
+}
+
+func (ch *checker) report(d diagnostic.Diagnostic) {
+	ch.info.Diagnostics = append(ch.info.Diagnostics, d)
+}
+
+/* missing reports whether a node is absent, even as a typed nil */
+func missing(node ast.Node) bool {
+	if node == nil {
+		return true
+	}
+	v := reflect.ValueOf(node)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+/* spanOf covers a node's source text, from its first token to its last */
+func spanOf(node ast.Node) diagnostic.Span {
+	return diagnostic.Span{
+		Start: diagnostic.TokenSpan(firstToken(node)).Start,
+		End:   diagnostic.TokenSpan(lastToken(node)).End,
+	}
+}
+
+func firstToken(node ast.Node) token.Token {
+	var first ast.Node
+	switch n := node.(type) {
+	case *ast.InfixExpression:
+		first = n.Left
+	case *ast.AssignExpression:
+		first = n.Target
+	case *ast.CallExpression:
+		first = n.Function
+	case *ast.IndexExpression:
+		first = n.Left
+	case *ast.ExpressionStatement:
+		first = n.Expression
+	}
+	if !missing(first) {
+		return firstToken(first)
+	}
+	return tokenOf(node)
+}
+
+func lastToken(node ast.Node) token.Token {
+	var last ast.Node
+	var closing token.Token
+	switch n := node.(type) {
+	case *ast.PrefixExpression:
+		last = n.Right
+	case *ast.InfixExpression:
+		last = n.Right
+	case *ast.AssignExpression:
+		last = n.Value
+	case *ast.LetStatement:
+		last = n.Value
+	case *ast.ReturnStatement:
+		last = n.Value
+	case *ast.ExpressionStatement:
+		last = n.Expression
+	case *ast.IfExpression:
+		last = n.ElseBlock
+		if missing(last) {
+			last = n.IfBlock
+		}
+	case *ast.FunctionLiteral:
+		last = n.Body
+	case *ast.WhileStatement:
+		last = n.Body
+	case *ast.ForStatement:
+		last = n.Body
+	case *ast.ParenExpression:
+		closing = n.Rparen
+	case *ast.CallExpression:
+		closing = n.Rparen
+	case *ast.ArrayLiteral:
+		closing = n.Rbracket
+	case *ast.IndexExpression:
+		closing = n.Rbracket
+	case *ast.HashLiteral:
+		closing = n.Rbrace
+	case *ast.BlockStatement:
+		closing = n.Rbrace
+	}
+	switch {
+	case !missing(last):
+		return lastToken(last)
+	case closing.Type != "":
+		return closing
+	}
+	return tokenOf(node)
+}
+
+/* tokenOf gives a node's Token field, which every node but Program has */
+func tokenOf(node ast.Node) token.Token {
+	v := reflect.ValueOf(node)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		if field := v.Elem().FieldByName("Token"); field.IsValid() {
+			return field.Interface().(token.Token)
+		}
+	}
+	return token.Token{}
+}
@@ -0,0 +1,306 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/* A Type is a Basic, Array, Hash or Function type, or a type variable */
+type Type interface {
+	String() string
+	typ()
+}
+
+type Basic struct {
+	Name string
+}
+
+var (
+	Int    = &Basic{Name: "Int"}
+	Float  = &Basic{Name: "Float"}
+	Bool   = &Basic{Name: "Bool"}
+	String = &Basic{Name: "String"}
+	Null   = &Basic{Name: "Null"} // what statements and loops give
+)
+
+type Array struct {
+	Elem Type
+}
+
+type Hash struct {
+	Key   Type
+	Value Type
+}
+
+type Function struct {
+	Params []Type
+	Result Type
+}
+
+/*
+A Var stands for a type that isn't known yet. Unifying it with another type
+binds it to that type for good. A var in a generalized function type stands
+for any type, subject to its class.
+*/
+type Var struct {
+	instance Type  // what the var is bound to, or nil
+	level    int   // how many lets deep it was made, for generalizing
+	class    class // what sort of type it can be bound to
+}
+
+func (t *Basic) typ()    {}
+func (t *Array) typ()    {}
+func (t *Hash) typ()     {}
+func (t *Function) typ() {}
+func (t *Var) typ()      {}
+
+/*
+A class limits what a var can stand for, so that a function like
+fn(a, b) { a + b } can be used for any type that has +, and no others
+*/
+type class uint8
+
+const (
+	numeric  class = 1 << iota // Int or Float
+	addable                    // a number or a String
+	hashable                   // anything usable as a hash key
+)
+
+/* allows checks that a type other than a Var belongs to every class in c */
+func (c class) allows(t Type) bool {
+	var has class
+	switch t {
+	case Int, Float:
+		has = numeric | addable | hashable
+	case String:
+		has = addable | hashable
+	case Bool:
+		has = hashable
+	}
+	return c&has == c
+}
+
+func (c class) String() string {
+	switch {
+	case c&numeric != 0:
+		return "a number"
+	case c&addable != 0:
+		return "a number or a string"
+	default:
+		return "usable as a hash key"
+	}
+}
+
+/* prune follows bound vars to the type they stand for */
+func prune(t Type) Type {
+	for {
+		v, ok := t.(*Var)
+		if !ok || v.instance == nil {
+			return t
+		}
+		t = v.instance
+	}
+}
+
+func (t *Basic) String() string    { return t.Name }
+func (t *Array) String() string    { return typeString(t) }
+func (t *Hash) String() string     { return typeString(t) }
+func (t *Function) String() string { return typeString(t) }
+func (t *Var) String() string      { return typeString(t) }
+
+func typeString(t Type) string {
+	return typeStrings(t)[0]
+}
+
+/*
+typeStrings writes out types with their vars named a, b, c and so on, in the
+order they first appear, so a var has the same name in each of them
+*/
+func typeStrings(types ...Type) []string {
+	var out bytes.Buffer
+	names := map[*Var]string{}
+	var write func(t Type)
+	write = func(t Type) {
+		switch t := prune(t).(type) {
+		case *Basic:
+			out.WriteString(t.Name)
+		case *Array:
+			out.WriteString("[")
+			write(t.Elem)
+			out.WriteString("]")
+		case *Hash:
+			out.WriteString("{")
+			write(t.Key)
+			out.WriteString(": ")
+			write(t.Value)
+			out.WriteString("}")
+		case *Function:
+			out.WriteString("fn(")
+			for i, param := range t.Params {
+				if i > 0 {
+					out.WriteString(", ")
+				}
+				write(param)
+			}
+			out.WriteString(") -> ")
+			write(t.Result)
+		case *Var:
+			name, ok := names[t]
+			if !ok {
+				name = varName(len(names))
+				names[t] = name
+			}
+			out.WriteString(name)
+		}
+	}
+	strs := make([]string, len(types))
+	for i, t := range types {
+		out.Reset()
+		write(t)
+		strs[i] = out.String()
+	}
+	return strs
+}
+
+/* varName gives a, b, ... z, then a1, b1 and so on */
+func varName(i int) string {
+	name := string(rune('a' + i%26))
+	if i >= 26 {
+		name += fmt.Sprint(i / 26)
+	}
+	return name
+}
+
+/* A unifyError explains why two types can't be made the same */
+type unifyError struct {
+	message string
+}
+
+func (e *unifyError) Error() string { return e.message }
+
+func mismatch(a, b Type) error {
+	strs := typeStrings(a, b)
+	return &unifyError{fmt.Sprintf("%s doesn't match %s", strs[0], strs[1])}
+}
+
+/* unify makes a and b the same type by binding vars, if it can */
+func unify(a, b Type) error {
+	a, b = prune(a), prune(b)
+	if a == b {
+		return nil
+	}
+	if v, ok := a.(*Var); ok {
+		return bind(v, b)
+	}
+	if v, ok := b.(*Var); ok {
+		return bind(v, a)
+	}
+
+	switch a := a.(type) {
+	case *Array:
+		if b, ok := b.(*Array); ok {
+			if unify(a.Elem, b.Elem) != nil {
+				return mismatch(a, b)
+			}
+			return nil
+		}
+	case *Hash:
+		if b, ok := b.(*Hash); ok {
+			if unify(a.Key, b.Key) != nil || unify(a.Value, b.Value) != nil {
+				return mismatch(a, b)
+			}
+			return nil
+		}
+	case *Function:
+		if b, ok := b.(*Function); ok && len(a.Params) == len(b.Params) {
+			for i := range a.Params {
+				if unify(a.Params[i], b.Params[i]) != nil {
+					return mismatch(a, b)
+				}
+			}
+			if unify(a.Result, b.Result) != nil {
+				return mismatch(a, b)
+			}
+			return nil
+		}
+	}
+	return mismatch(a, b)
+}
+
+func bind(v *Var, t Type) error {
+	if other, ok := t.(*Var); ok {
+		other.class |= v.class
+		if v.level < other.level {
+			other.level = v.level
+		}
+		v.instance = other
+		return nil
+	}
+	if occurs(v, t) {
+		return &unifyError{fmt.Sprintf("%s would have to contain itself", typeString(t))}
+	}
+	if _, ok := t.(*Basic); (ok && !v.class.allows(t)) || (!ok && v.class != 0) {
+		return &unifyError{fmt.Sprintf("%s is not %s", t, v.class)}
+	}
+	adjustLevels(t, v.level)
+	v.instance = t
+	return nil
+}
+
+/* occurs checks whether v is inside t, which would make t infinite */
+func occurs(v *Var, t Type) bool {
+	switch t := prune(t).(type) {
+	case *Var:
+		return t == v
+	case *Array:
+		return occurs(v, t.Elem)
+	case *Hash:
+		return occurs(v, t.Key) || occurs(v, t.Value)
+	case *Function:
+		for _, param := range t.Params {
+			if occurs(v, param) {
+				return true
+			}
+		}
+		return occurs(v, t.Result)
+	}
+	return false
+}
+
+/* adjustLevels stops the vars in t being generalized any deeper than level */
+func adjustLevels(t Type, level int) {
+	switch t := prune(t).(type) {
+	case *Var:
+		if t.level > level {
+			t.level = level
+		}
+	case *Array:
+		adjustLevels(t.Elem, level)
+	case *Hash:
+		adjustLevels(t.Key, level)
+		adjustLevels(t.Value, level)
+	case *Function:
+		for _, param := range t.Params {
+			adjustLevels(param, level)
+		}
+		adjustLevels(t.Result, level)
+	}
+}
+
+/* resolve replaces the bound vars in t with what they stand for */
+func resolve(t Type) Type {
+	switch t := prune(t).(type) {
+	case *Array:
+		return &Array{Elem: resolve(t.Elem)}
+	case *Hash:
+		return &Hash{Key: resolve(t.Key), Value: resolve(t.Value)}
+	case *Function:
+		params := make([]Type, len(t.Params))
+		for i, param := range t.Params {
+			params[i] = resolve(param)
+		}
+		return &Function{Params: params, Result: resolve(t.Result)}
+	default:
+		return t
+	}
+}
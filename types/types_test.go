@@ -0,0 +1,220 @@
+package types
+
+import (
+	"github.com/cowlet/moncow/ast"
+	"github.com/cowlet/moncow/lexer"
+	"github.com/cowlet/moncow/parser"
+	"reflect"
+	"testing"
+)
+
+func check(t *testing.T, input string) (*ast.Program, *Info) {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("Parser errors for %q: %v", input, p.Errors())
+	}
+	return program, Check(program)
+}
+
+/* lastExpression is the expression of a program's final statement */
+func lastExpression(t *testing.T, program *ast.Program) ast.Expression {
+	t.Helper()
+	stmt, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Last statement of %q isn't an expression", program)
+	}
+	return stmt.Expression
+}
+
+func TestInference(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1", "Int"},
+		{"1.5", "Float"},
+		{`"a" + "b"`, "String"},
+		{"!5", "Bool"},
+		{"- 2.5", "Float"},
+		{"1 + 2 * 3", "Int"},
+		{"1 + 2.5", "Float"},
+		{"2 ** 3", "Int"},
+		/* The evaluator gives 2 ** -1 as 0.5, so any exponent that might be negative gives a Float */
+		{"2 ** -1", "Float"},
+		{"let n = 3; 2 ** n", "Float"},
+		{"2.5 ** 2", "Float"},
+		{"fn(n) { 2 ** n }", "fn(Int) -> Float"},
+		{"1 < 2.5 && true", "Bool"},
+		{"[1, 2, 3]", "[Int]"},
+		{"[]", "[a]"},
+		{`{"a": 1, "b": 2}`, "{String: Int}"},
+		{"[[1], []]", "[[Int]]"},
+		{"let a = [1, 2]; a[0]", "Int"},
+		{`let h = {"a": true}; h["a"]`, "Bool"},
+		{"if (true) { 1 } else { 2 }", "Int"},
+		{"if (true) { 1 }", "Null"},
+		{"if (true) { 1 } else if (false) { 2 } else { 3 }", "Int"},
+		{"let x = 1; x = 2", "Int"},
+		{"let x = 1.5; x += 1", "Float"},
+		{"fn(x) { x }", "fn(a) -> a"},
+		{"fn(x, y) { x + y }", "fn(a, a) -> a"},
+		{"fn(x) { x + 1 }", "fn(Int) -> Int"},
+		{"fn(f, x) { f(f(x)) }", "fn(fn(a) -> a, a) -> a"},
+		/* Indexing something not otherwise known is taken as an array or hash */
+		{"fn(a) { a[0] }", "fn([a]) -> a"},
+		{"fn(a) { a[0] + 1; }", "fn([Int]) -> Int"},
+		{`fn(h) { h["k"] }`, "fn({String: a}) -> a"},
+		{"fn(h, k) { h[k] }", "fn(a, b) -> c"},
+		{"fn(a) { let x = a[0]; a = [true]; x }", "fn([Bool]) -> Bool"},
+		{"fn(x) { if (x) { return 1; } 2 }", "fn(a) -> Int"},
+		{"fn() { while (true) { break; } }", "fn() -> Null"},
+		{"fn() { }", "fn() -> Null"},
+		{"let f = fn(x) { x }; f", "fn(a) -> a"},
+		/* Functions declared with let are polymorphic */
+		{`let id = fn(x) { x }; [id(1)][0] + 1; id("a")`, "String"},
+		{"let add = fn(a, b) { a + b }; add(1.5, 2.5)", "Float"},
+		{"let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; fib", "fn(Int) -> Int"},
+		{"let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; let odd = fn(n) { even(n - 1) }; odd",
+			"fn(Int) -> Bool"},
+		{"let map = fn(a, f) { let out = []; for (let i = 0; i < 3; i += 1) { out = [f(a[i])]; } out }; map",
+			"fn([a], fn(a) -> b) -> [b]"},
+		{`let map = fn(a, f) { [f(a[0])] }; map([1], fn(x) { x > 0 })`, "[Bool]"},
+		/* Values aren't generalized, so using them fixes their type */
+		{"let a = []; let b = a; b = [1]; a", "[Int]"},
+	}
+
+	for _, tt := range tests {
+		program, info := check(t, tt.input)
+		for _, d := range info.Diagnostics {
+			t.Errorf("Unexpected diagnostic for %q: %s", tt.input, d)
+		}
+		typ := info.TypeOf(lastExpression(t, program))
+		if typ == nil || typ.String() != tt.expected {
+			t.Errorf("Type of %q wrong. Expected %s, got %v", tt.input, tt.expected, typ)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"true + 1.5", []string{"1:1: Invalid operands to +: Bool and Float"}},
+		{`"a" - "b"`, []string{`1:1: Invalid operands to -: String and String`}},
+		{`1 == "a"`, []string{"1:1: Invalid operands to ==: Int and String"}},
+		{"-true", []string{"1:1: Invalid operand to -: Bool"}},
+		{`[1, "two"]`, []string{"1:5: Mismatched array element: String doesn't match Int"}},
+		{`{"a": 1, 2: 2}`, []string{"1:10: Mismatched hash key: Int doesn't match String"}},
+		{"{[1]: 1}", []string{"1:2: Mismatched hash key: [Int] is not usable as a hash key"}},
+		{`if (true) { 1 } else { "a" }`, []string{
+			"1:22: Mismatched if branches: String doesn't match Int",
+		}},
+		{"let x = 1; x = true", []string{"1:16: Mismatched assignment: Bool doesn't match Int"}},
+		{"let x = 1; x += 1.5", []string{"1:12: Mismatched assignment: Float doesn't match Int"}},
+		{"let f = fn(x) { x + 1 }; f(true)", []string{
+			"1:28: Mismatched argument 1: Bool doesn't match Int",
+		}},
+		{"let f = fn(x) { x }; f(1, 2)", []string{"1:22: Expected 1 argument, got 2"}},
+		{"let f = fn(x) { x(x) }", []string{
+			"1:17: Mismatched call: fn(a) -> b would have to contain itself",
+		}},
+		{"fn(x) { if (x) { return 1; } }", []string{
+			"1:9: Mismatched return value: Null doesn't match Int",
+		}},
+		{`fn(x) { if (x) { return 1; } "a" }`, []string{
+			"1:30: Mismatched return value: String doesn't match Int",
+		}},
+		{"let x = 1; x(2)", []string{"1:12: Int can't be called"}},
+		{"let x = 1; x[0]", []string{"1:12: Int can't be indexed"}},
+		{`let a = [1]; a["b"]`, []string{"1:16: Mismatched index: String doesn't match Int"}},
+		{`fn(a) { a[0]; a = 5; }`, []string{"1:9: Int can't be indexed"}},
+		/* Mixing numbers only works where the operator can see them */
+		{"let add = fn(a, b) { a + b }; add(1, 2.5)", []string{
+			"1:38: Mismatched argument 2: Float doesn't match Int",
+		}},
+		{"let add = fn(a, b) { a + b }; add(true, false)", []string{
+			"1:35: Mismatched argument 1: Bool is not a number or a string",
+			"1:41: Mismatched argument 2: Bool is not a number or a string",
+		}},
+		{"let f = fn() { g(1) }; let g = fn(s) { s + 1.5 };", []string{
+			"1:32: Mismatched earlier use: fn(Float) -> Float doesn't match fn(Int) -> a",
+		}},
+		/* A function that's assigned to isn't polymorphic, so the new value has to fit every use */
+		{`let id = fn(x) { x }; id = fn(x) { x + 1 }; id("a")`, []string{
+			"1:48: Mismatched argument 1: String doesn't match Int",
+		}},
+		{`let id = fn(x) { x }; id(1); id = fn(x) { x + 1 }; id(2)`, []string{}},
+		/* Undefined names are for the resolver to report */
+		{"y + 1", []string{}},
+	}
+
+	for _, tt := range tests {
+		_, info := check(t, tt.input)
+		got := []string{}
+		for _, d := range info.Diagnostics {
+			got = append(got, d.String())
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("Diagnostics for %q wrong. Expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestTypeOfEveryExpression(t *testing.T) {
+	input := `
+let f = fn(a, h) {
+	let total = 0;
+	for (let i = 0; i < 3; i += 1) {
+		total = total + a[i] * h["k"];
+	}
+	while (total > 10) { total -= 1; }
+	if (!(total == 0)) { [total] } else { [-1] }
+};
+f([1, 2, 3], {"k": 2})[0];
+`
+	program, info := check(t, input)
+	for _, d := range info.Diagnostics {
+		t.Errorf("Unexpected diagnostic: %s", d)
+	}
+	ast.Inspect(program, func(node ast.Node) bool {
+		if exp, ok := node.(ast.Expression); ok && info.TypeOf(exp) == nil {
+			t.Errorf("No type for %s", exp)
+		}
+		return true
+	})
+	if typ := info.TypeOf(lastExpression(t, program)); typ != Int {
+		t.Errorf("Type of the program's result wrong. Expected Int, got %v", typ)
+	}
+	if typ := info.TypeOf(&ast.Identifier{Value: "f"}); typ != nil {
+		t.Errorf("TypeOf an expression not in the program gave %s", typ)
+	}
+}
+
+func TestTypeStrings(t *testing.T) {
+	a, b := &Var{}, &Var{}
+	tests := []struct {
+		typ      Type
+		expected string
+	}{
+		{Null, "Null"},
+		{&Array{Elem: &Hash{Key: String, Value: Float}}, "[{String: Float}]"},
+		{&Function{Params: []Type{b, a, b}, Result: a}, "fn(a, b, a) -> b"},
+		{&Function{Result: &Function{Params: []Type{Bool}, Result: Int}}, "fn() -> fn(Bool) -> Int"},
+	}
+	for _, tt := range tests {
+		if got := tt.typ.String(); got != tt.expected {
+			t.Errorf("String wrong. Expected %s, got %s", tt.expected, got)
+		}
+	}
+
+	bound := &Var{}
+	if err := unify(bound, &Array{Elem: Int}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bound.String(); got != "[Int]" {
+		t.Errorf("Bound var's String wrong. Expected [Int], got %s", got)
+	}
+}